@@ -0,0 +1,187 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+
+	// clients reject leaf certificates that are valid for longer than 398 days
+	leafValidity = 397 * 24 * time.Hour
+	caValidity   = 10 * 365 * 24 * time.Hour
+)
+
+// CertificateAuthority mints leaf certificates for the hosts that clients connect to
+type CertificateAuthority struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+	defaultHost string
+
+	lock   *sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// LoadOrCreateCertificateAuthority loads the CA certificate and key from dir, generating
+// and persisting them there on first run. Leaf certificates are minted for defaultHost
+// when the client does not send SNI.
+func LoadOrCreateCertificateAuthority(dir string, defaultHost string) (*CertificateAuthority, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := createCertificateAuthority(dir, certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load CA from %s: %s", dir, err)
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CA certificate: %s", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !certificate.IsCA {
+		return nil, errors.New("CA certificate can not sign certificates")
+	}
+	return &CertificateAuthority{
+		certificate: certificate,
+		key:         key,
+		defaultHost: defaultHost,
+		lock:        &sync.Mutex{},
+		leaves:      make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// CertificatePath returns where the CA certificate that clients have to trust is stored
+func CertificatePath(dir string) string {
+	return filepath.Join(dir, caCertFile)
+}
+
+// GetCertificate returns a leaf certificate for the host name the client asked for, it can
+// be used as tls.Config.GetCertificate
+func (ca *CertificateAuthority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if len(host) == 0 {
+		host = ca.defaultHost
+	}
+	return ca.Certificate(host)
+}
+
+// Certificate returns a leaf certificate for host, minting it on first use
+func (ca *CertificateAuthority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	ca.lock.Lock()
+	defer ca.lock.Unlock()
+	if leaf, ok := ca.leaves[host]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+	leaf, err := ca.mint(host)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create certificate for %s: %s", host, err)
+	}
+	ca.leaves[host] = leaf
+	return leaf, nil
+}
+
+func (ca *CertificateAuthority) mint(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(host, leafValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func createCertificateAuthority(dir string, certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newTemplate("HTTPCeption CA", caValidity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("Failed to create CA certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// the key must stay private to this user
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create CA directory: %s", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return fmt.Errorf("Failed to write CA key: %s", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("Failed to write CA certificate: %s", err)
+	}
+	return nil
+}
+
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"HTTPCeption"},
+		},
+
+		// allow for clocks that are slightly off
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
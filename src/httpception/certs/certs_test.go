@@ -0,0 +1,101 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	ca, err := LoadOrCreateCertificateAuthority(dir, "localhost")
+	if err != nil {
+		t.Fatalf("LoadOrCreateCertificateAuthority failed: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	tests := []struct {
+		serverName string
+		host       string
+	}{
+		{serverName: "example.com", host: "example.com"},
+		{serverName: "API.Example.com", host: "api.example.com"},
+		{serverName: "", host: "localhost"},
+		{serverName: "127.0.0.1", host: "127.0.0.1"},
+		{serverName: "::1", host: "::1"},
+	}
+	for _, test := range tests {
+		leaf, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Errorf("GetCertificate(%q) failed: %s", test.serverName, err)
+			continue
+		}
+
+		// clients that trust the CA accept the leaf for the host, and only for the host
+		options := x509.VerifyOptions{DNSName: test.host, Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := leaf.Leaf.Verify(options); err != nil {
+			t.Errorf("GetCertificate(%q) minted a certificate that does not verify for %s: %s", test.serverName, test.host, err)
+		}
+		if err := leaf.Leaf.VerifyHostname("other.example.com"); err == nil {
+			t.Errorf("GetCertificate(%q) minted a certificate that is valid for other hosts", test.serverName)
+		}
+		if validity := leaf.Leaf.NotAfter.Sub(time.Now()); validity > leafValidity {
+			t.Errorf("GetCertificate(%q) minted a certificate valid for %s, longer than %s", test.serverName, validity, leafValidity)
+		}
+		if len(leaf.Certificate) != 2 {
+			t.Errorf("GetCertificate(%q) sends %d certificates, want the leaf and the CA", test.serverName, len(leaf.Certificate))
+		}
+
+		// leaves are minted once per host
+		again, _ := ca.Certificate(test.host)
+		if again != leaf {
+			t.Errorf("Certificate(%q) minted a new certificate", test.host)
+		}
+	}
+}
+
+func TestLoadOrCreateCertificateAuthority(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	created, err := LoadOrCreateCertificateAuthority(dir, "localhost")
+	if err != nil {
+		t.Fatalf("creating the CA failed: %s", err)
+	}
+	loaded, err := LoadOrCreateCertificateAuthority(dir, "localhost")
+	if err != nil {
+		t.Fatalf("loading the CA failed: %s", err)
+	}
+	if !loaded.certificate.Equal(created.certificate) {
+		t.Errorf("loading the CA created a new one")
+	}
+
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{path: dir, mode: 0700 | os.ModeDir},
+		{path: filepath.Join(dir, caKeyFile), mode: 0600},
+		{path: CertificatePath(dir), mode: 0644},
+	}
+	for _, test := range tests {
+		info, err := os.Stat(test.path)
+		if err != nil {
+			t.Errorf("Stat(%s) failed: %s", test.path, err)
+			continue
+		}
+		if info.Mode() != test.mode {
+			t.Errorf("%s has mode %v, want %v", test.path, info.Mode(), test.mode)
+		}
+	}
+
+	// a certificate without its key is not a usable CA
+	if err := os.WriteFile(filepath.Join(dir, caKeyFile), []byte("not a key"), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	if _, err := LoadOrCreateCertificateAuthority(dir, "localhost"); err == nil {
+		t.Errorf("loaded a CA with a broken key")
+	}
+}
@@ -0,0 +1,226 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"httpception/interceptor"
+)
+
+// BreakPhase chooses in which phases of an exchange the debugger pauses
+type BreakPhase uint
+
+const (
+
+	// BreakBoth pauses requests and responses
+	BreakBoth BreakPhase = iota
+
+	// BreakRequest only pauses requests
+	BreakRequest = iota
+
+	// BreakResponse only pauses responses
+	BreakResponse = iota
+)
+
+var breakPhaseNames = []string{"both", "request", "response"}
+
+// ParseBreakPhase parses the name of a BreakPhase
+func ParseBreakPhase(name string) (BreakPhase, error) {
+	for i, n := range breakPhaseNames {
+		if strings.EqualFold(n, name) {
+			return BreakPhase(i), nil
+		}
+	}
+	return BreakBoth, fmt.Errorf("Unknown break phase %s, expected both, request or response", name)
+}
+
+func (b BreakPhase) String() string {
+	if int(b) < len(breakPhaseNames) {
+		return breakPhaseNames[b]
+	}
+	return strconv.Itoa(int(b))
+}
+
+// MarshalText sends a BreakPhase to clients by its name
+func (b BreakPhase) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText reads a BreakPhase by its name, an empty one means both
+func (b *BreakPhase) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*b = BreakBoth
+		return nil
+	}
+	phase, err := ParseBreakPhase(string(text))
+	*b = phase
+	return err
+}
+
+// includes reports whether the debugger pauses in a phase
+func (b BreakPhase) includes(phase interceptor.Phase) bool {
+	return b == BreakBoth || (b == BreakRequest && phase == interceptor.RequestPhase) || (b == BreakResponse && phase == interceptor.ResponsePhase)
+}
+
+// Breakpoint pauses the exchanges that match all of its conditions, empty ones match anything
+type Breakpoint struct {
+	ID     uint64
+	Method string
+
+	// the host the request is sent to without its port, a leading "*." matches every subdomain
+	Host string
+
+	// a glob as understood by path.Match, or a regular expression
+	Path       string
+	PathRegexp string
+
+	// the header has to be present, and have the value if one is given
+	Header      string
+	HeaderValue string
+
+	// matched against the body of the request, or of the response when it is intercepted
+	BodyContains string
+
+	// a breakpoint with a status only pauses responses
+	Status int
+
+	// the phases to pause in, within those chosen for the whole debugger
+	BreakPhase BreakPhase
+
+	pathRegexp *regexp.Regexp
+}
+
+// ParseBreakpoint parses a breakpoint sent by the frontend as JSON
+func ParseBreakpoint(raw string) (Breakpoint, error) {
+	var breakpoint Breakpoint
+	if err := json.Unmarshal([]byte(raw), &breakpoint); err != nil {
+		return breakpoint, fmt.Errorf("Failed to parse breakpoint: %s", err)
+	}
+	if _, err := path.Match(breakpoint.Path, ""); err != nil {
+		return breakpoint, fmt.Errorf("Failed to parse breakpoint path %s: %s", breakpoint.Path, err)
+	}
+	if len(breakpoint.PathRegexp) > 0 {
+		pathRegexp, err := regexp.Compile(breakpoint.PathRegexp)
+		if err != nil {
+			return breakpoint, fmt.Errorf("Failed to parse breakpoint path regexp %s: %s", breakpoint.PathRegexp, err)
+		}
+		breakpoint.pathRegexp = pathRegexp
+	}
+	breakpoint.Host = strings.ToLower(breakpoint.Host)
+	return breakpoint, nil
+}
+
+// matches reports whether an exchange matches the breakpoint in a phase. The host is the
+// one the client asked for, the status is 0 while the request is intercepted, and the body
+// is that of the intercepted message.
+func (b Breakpoint) matches(phase interceptor.Phase, host string, request *http.Request, status int, body []byte) bool {
+	if !b.BreakPhase.includes(phase) {
+		return false
+	}
+	if len(b.Method) > 0 && !strings.EqualFold(b.Method, request.Method) {
+		return false
+	}
+	if len(b.Host) > 0 && !b.matchesHost(host) {
+		return false
+	}
+	if len(b.Path) > 0 {
+		if ok, _ := path.Match(b.Path, request.URL.Path); !ok {
+			return false
+		}
+	}
+	if b.pathRegexp != nil && !b.pathRegexp.MatchString(request.URL.Path) {
+		return false
+	}
+	if len(b.Header) > 0 {
+		values, ok := request.Header[http.CanonicalHeaderKey(b.Header)]
+		if !ok || (len(b.HeaderValue) > 0 && !slices.Contains(values, b.HeaderValue)) {
+			return false
+		}
+	}
+	if len(b.BodyContains) > 0 && !bytes.Contains(body, []byte(b.BodyContains)) {
+		return false
+	}
+	if b.Status != 0 && b.Status != status {
+		return false
+	}
+	return true
+}
+
+func (b Breakpoint) matchesHost(host string) bool {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(b.Host, "*.") {
+		return strings.HasSuffix(host, b.Host[1:])
+	}
+	return b.Host == host
+}
+
+// breakpointList holds the breakpoints set in the debugger
+type breakpointList struct {
+	lock        *sync.Mutex
+	lastID      uint64
+	breakpoints []Breakpoint
+}
+
+// newBreakpointList creates an empty breakpointList
+func newBreakpointList() *breakpointList {
+	return &breakpointList{
+		lock:        &sync.Mutex{},
+		breakpoints: make([]Breakpoint, 0),
+	}
+}
+
+// add assigns an ID to a breakpoint and sets it
+func (l *breakpointList) add(breakpoint Breakpoint) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lastID++
+	breakpoint.ID = l.lastID
+	l.breakpoints = append(l.breakpoints, breakpoint)
+}
+
+// remove removes a breakpoint, returning false if there is none with the ID
+func (l *breakpointList) remove(id uint64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, b := range l.breakpoints {
+		if b.ID == id {
+			l.breakpoints = append(l.breakpoints[:i], l.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether an exchange should pause in a phase. Without breakpoints every exchange pauses.
+func (l *breakpointList) matches(phase interceptor.Phase, host string, request *http.Request, status int, body []byte) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.breakpoints) == 0 {
+		return true
+	}
+	for _, b := range l.breakpoints {
+		if b.matches(phase, host, request, status, body) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the breakpoints that are set
+func (l *breakpointList) list() []Breakpoint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]Breakpoint{}, l.breakpoints...)
+}
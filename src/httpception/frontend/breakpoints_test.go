@@ -0,0 +1,182 @@
+package frontend
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"httpception/interceptor"
+)
+
+func TestParseBreakpoint(t *testing.T) {
+	tests := []struct {
+		raw  string
+		host string
+		err  bool
+	}{
+		{raw: `{}`},
+		{raw: `{"Host": "API.Example.com", "Path": "/users/*"}`, host: "api.example.com"},
+		{raw: `{"PathRegexp": "^/v[0-9]+/"}`},
+		{raw: `{"Path": "/users/["}`, err: true},
+		{raw: `{"PathRegexp": "("}`, err: true},
+		{raw: `not json`, err: true},
+	}
+	for _, test := range tests {
+		breakpoint, err := ParseBreakpoint(test.raw)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseBreakpoint(%s) succeeded, want an error", test.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseBreakpoint(%s) failed: %s", test.raw, err)
+			continue
+		}
+		if breakpoint.Host != test.host {
+			t.Errorf("ParseBreakpoint(%s) has host %q, want %q", test.raw, breakpoint.Host, test.host)
+		}
+	}
+}
+
+func TestBreakpointMatches(t *testing.T) {
+	tests := []struct {
+		breakpoint string
+		phase      interceptor.Phase
+		method     string
+		host       string
+		path       string
+		header     map[string]string
+		status     int
+		body       string
+		matches    bool
+	}{
+		{breakpoint: `{}`, path: "/", matches: true},
+		{breakpoint: `{"Method": "post"}`, method: "POST", path: "/", matches: true},
+		{breakpoint: `{"Method": "POST"}`, method: "GET", path: "/"},
+		{breakpoint: `{"Host": "api.local"}`, host: "API.local:3333", path: "/", matches: true},
+		{breakpoint: `{"Host": "api.local"}`, host: "web.local", path: "/"},
+		{breakpoint: `{"Host": "*.shop.local"}`, host: "eu.shop.local", path: "/", matches: true},
+		{breakpoint: `{"Host": "*.shop.local"}`, host: "shop.local", path: "/"},
+		{breakpoint: `{"Path": "/users/*"}`, path: "/users/7", matches: true},
+		{breakpoint: `{"Path": "/users/*"}`, path: "/users/7/orders"},
+		{breakpoint: `{"PathRegexp": "^/v[0-9]+/"}`, path: "/v2/orders", matches: true},
+		{breakpoint: `{"PathRegexp": "^/v[0-9]+/"}`, path: "/orders"},
+		{breakpoint: `{"Header": "x-debug"}`, path: "/", header: map[string]string{"X-Debug": ""}, matches: true},
+		{breakpoint: `{"Header": "X-Debug"}`, path: "/"},
+		{breakpoint: `{"Header": "X-Debug", "HeaderValue": "1"}`, path: "/", header: map[string]string{"X-Debug": "1"}, matches: true},
+		{breakpoint: `{"Header": "X-Debug", "HeaderValue": "1"}`, path: "/", header: map[string]string{"X-Debug": "0"}},
+		{breakpoint: `{"BodyContains": "token"}`, path: "/", body: `{"token": 1}`, matches: true},
+		{breakpoint: `{"BodyContains": "token"}`, path: "/", body: `{}`},
+		{breakpoint: `{"Status": 500}`, phase: interceptor.ResponsePhase, path: "/", status: 500, matches: true},
+		{breakpoint: `{"Status": 500}`, phase: interceptor.ResponsePhase, path: "/", status: 200},
+		{breakpoint: `{"Status": 500}`, phase: interceptor.RequestPhase, path: "/"},
+		{breakpoint: `{"Method": "GET", "Path": "/users/*"}`, method: "GET", path: "/orders/1"},
+	}
+	for _, test := range tests {
+		breakpoint, err := ParseBreakpoint(test.breakpoint)
+		if err != nil {
+			t.Fatalf("ParseBreakpoint(%s) failed: %s", test.breakpoint, err)
+		}
+		method := test.method
+		if len(method) == 0 {
+			method = "GET"
+		}
+		request := httptest.NewRequest(method, test.path, strings.NewReader(test.body))
+		for name, value := range test.header {
+			request.Header.Set(name, value)
+		}
+		if matches := breakpoint.matches(test.phase, test.host, request, test.status, []byte(test.body)); matches != test.matches {
+			t.Errorf("%s matches %s %s%s (status %d) = %t, want %t", test.breakpoint,
+				method, test.host, test.path, test.status, matches, test.matches)
+		}
+	}
+}
+
+func TestBreakpointList(t *testing.T) {
+	breakpoints := newBreakpointList()
+	request := httptest.NewRequest("GET", "/orders", nil)
+
+	// without breakpoints every exchange pauses
+	if !breakpoints.matches(interceptor.RequestPhase, "", request, 0, nil) {
+		t.Errorf("an empty list does not pause")
+	}
+	for _, raw := range []string{`{"Path": "/users"}`, `{"Path": "/orders"}`} {
+		breakpoint, _ := ParseBreakpoint(raw)
+		breakpoints.add(breakpoint)
+	}
+	if list := breakpoints.list(); len(list) != 2 || list[0].ID != 1 || list[1].ID != 2 {
+		t.Errorf("list() = %+v, want IDs 1 and 2", list)
+	}
+	if !breakpoints.matches(interceptor.RequestPhase, "", request, 0, nil) {
+		t.Errorf("the /orders breakpoint does not pause /orders")
+	}
+	if !breakpoints.remove(2) || breakpoints.remove(2) {
+		t.Errorf("remove(2) did not remove the breakpoint once")
+	}
+	if breakpoints.matches(interceptor.RequestPhase, "", request, 0, nil) {
+		t.Errorf("/orders pauses after its breakpoint was removed")
+	}
+}
+
+func TestParseBreakPhase(t *testing.T) {
+	tests := []struct {
+		name  string
+		phase BreakPhase
+		err   bool
+	}{
+		{name: "both", phase: BreakBoth},
+		{name: "Request", phase: BreakRequest},
+		{name: "RESPONSE", phase: BreakResponse},
+		{name: "never", err: true},
+	}
+	for _, test := range tests {
+		phase, err := ParseBreakPhase(test.name)
+		if test.err != (err != nil) || phase != test.phase {
+			t.Errorf("ParseBreakPhase(%q) = %s, %v, want %s", test.name, phase, err, test.phase)
+		}
+
+		// phases travel to and from clients by name, an empty one meaning both
+		if test.err {
+			continue
+		}
+		text, _ := phase.MarshalText()
+		var parsed BreakPhase
+		if err := parsed.UnmarshalText(text); err != nil || parsed != phase {
+			t.Errorf("%s sent as %q came back as %s, %v", phase, text, parsed, err)
+		}
+	}
+	var empty BreakPhase = BreakResponse
+	if err := empty.UnmarshalText(nil); err != nil || empty != BreakBoth {
+		t.Errorf("an empty break phase is %s, %v, want both", empty, err)
+	}
+}
+
+func TestBreakpointPhases(t *testing.T) {
+	tests := []struct {
+		breakpoint string
+		phase      interceptor.Phase
+		matches    bool
+	}{
+		{breakpoint: `{}`, phase: interceptor.RequestPhase, matches: true},
+		{breakpoint: `{}`, phase: interceptor.ResponsePhase, matches: true},
+		{breakpoint: `{"BreakPhase": "both"}`, phase: interceptor.ResponsePhase, matches: true},
+		{breakpoint: `{"BreakPhase": "request"}`, phase: interceptor.RequestPhase, matches: true},
+		{breakpoint: `{"BreakPhase": "request"}`, phase: interceptor.ResponsePhase},
+		{breakpoint: `{"BreakPhase": "response"}`, phase: interceptor.RequestPhase},
+		{breakpoint: `{"BreakPhase": "response"}`, phase: interceptor.ResponsePhase, matches: true},
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	for _, test := range tests {
+		breakpoint, err := ParseBreakpoint(test.breakpoint)
+		if err != nil {
+			t.Fatalf("ParseBreakpoint(%s) failed: %s", test.breakpoint, err)
+		}
+		if matches := breakpoint.matches(test.phase, "", request, 0, nil); matches != test.matches {
+			t.Errorf("%s matches in phase %d = %t, want %t", test.breakpoint, test.phase, matches, test.matches)
+		}
+	}
+	if _, err := ParseBreakpoint(`{"BreakPhase": "never"}`); err == nil {
+		t.Errorf("ParseBreakpoint accepted an unknown break phase")
+	}
+}
@@ -0,0 +1,115 @@
+package frontend
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"httpception/interceptor"
+)
+
+// RequestDetails describes a request so that clients do not have to parse raw HTTP
+type RequestDetails struct {
+	Method string
+
+	// the URL as it appears in the request line, absolute for requests to a forward proxy
+	URL  string
+	Host string
+
+	// the scheme and Host the client used, empty if unknown. Host is the upstream's once
+	// the request was routed.
+	Scheme     string
+	ClientHost string
+
+	Proto       string
+	Header      http.Header
+	Body        []byte
+	ContentType string
+	HeadersSize int
+	BodySize    int
+}
+
+// ResponseDetails describes a response so that clients do not have to parse raw HTTP
+type ResponseDetails struct {
+	StatusCode  int
+	Status      string
+	Proto       string
+	Header      http.Header
+	Body        []byte
+	ContentType string
+	HeadersSize int
+	BodySize    int
+}
+
+// NewRequestDetails describes a request, reading its body and replacing it with a copy
+func NewRequestDetails(request *http.Request) RequestDetails {
+	url := request.RequestURI
+	if len(url) == 0 {
+		url = request.URL.RequestURI()
+	}
+	details := RequestDetails{
+		Method:      request.Method,
+		URL:         url,
+		Host:        request.Host,
+		Proto:       request.Proto,
+		Header:      request.Header.Clone(),
+		Body:        interceptor.ReadBody(&request.Body),
+		ContentType: request.Header.Get("Content-Type"),
+	}
+	details.HeadersSize = len(details.head())
+	details.BodySize = len(details.Body)
+	return details
+}
+
+// newExchangeRequestDetails describes the request of an exchange along with how the client sent it
+func newExchangeRequestDetails(exchange *interceptor.Exchange) RequestDetails {
+	details := NewRequestDetails(exchange.Request)
+	details.Scheme, details.ClientHost = exchange.ClientScheme, exchange.ClientHost
+	return details
+}
+
+// NewResponseDetails describes a response, reading its body and replacing it with a copy
+func NewResponseDetails(response *http.Response) ResponseDetails {
+	details := ResponseDetails{
+		StatusCode:  response.StatusCode,
+		Status:      response.Status,
+		Proto:       response.Proto,
+		Header:      response.Header.Clone(),
+		Body:        interceptor.ReadBody(&response.Body),
+		ContentType: response.Header.Get("Content-Type"),
+	}
+	details.HeadersSize = len(details.head())
+	details.BodySize = len(details.Body)
+	return details
+}
+
+// Raw returns the request as raw HTTP, as it is edited in the debugger
+func (d RequestDetails) Raw() string {
+	return d.head() + string(d.Body)
+}
+
+// Raw returns the response as raw HTTP, as it is edited in the debugger
+func (d ResponseDetails) Raw() string {
+	return d.head() + string(d.Body)
+}
+
+func (d RequestDetails) head() string {
+	var b strings.Builder
+	b.WriteString(d.Method + " " + d.URL + " " + d.Proto + "\r\n")
+	b.WriteString("Host: " + d.Host + "\r\n")
+	d.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func (d ResponseDetails) head() string {
+	var b strings.Builder
+	status := d.Status
+	if len(status) == 0 {
+		status = strconv.Itoa(d.StatusCode) + " " + http.StatusText(d.StatusCode)
+	}
+	b.WriteString(d.Proto + " " + status + "\r\n")
+	d.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package frontend
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// ParseRequest parses a raw HTTP request as edited in the debugger
+func ParseRequest(raw string) (*http.Request, error) {
+	head, body := splitMessage(raw)
+	request, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head)))
+	if err != nil {
+		return nil, err
+	}
+	if body, err = decodeBody(request.TransferEncoding, body); err != nil {
+		return nil, err
+	}
+
+	// the body may have been edited, so recompute its length
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	request.ContentLength = int64(len(body))
+	request.TransferEncoding = nil
+	request.Header.Del("Transfer-Encoding")
+	if len(body) > 0 || request.Header.Get("Content-Length") != "" {
+		request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return request, nil
+}
+
+// ParseResponse parses a raw HTTP response as edited in the debugger
+func ParseResponse(raw string, request *http.Request) (*http.Response, error) {
+	head, body := splitMessage(raw)
+	response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(head)), request)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = decodeBody(response.TransferEncoding, body); err != nil {
+		return nil, err
+	}
+
+	// the body may have been edited, so recompute its length
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	response.TransferEncoding = nil
+	response.Header.Del("Transfer-Encoding")
+	if len(body) > 0 || response.Header.Get("Content-Length") != "" {
+		response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	// the length is known now, so the connection is no longer needed to delimit the body
+	response.Close = strings.EqualFold(response.Header.Get("Connection"), "close") || !response.ProtoAtLeast(1, 1)
+	return response, nil
+}
+
+// splitMessage splits a raw HTTP message into a well formed header and the body
+func splitMessage(raw string) (string, []byte) {
+	raw = strings.TrimLeft(raw, " \t\r\n")
+
+	// find the blank line separating the header from the body
+	end, sep := len(raw), 0
+	if i := strings.Index(raw, "\n\n"); i >= 0 {
+		end, sep = i, 2
+	}
+	if i := strings.Index(raw, "\n\r\n"); i >= 0 && i < end {
+		end, sep = i, 3
+	}
+
+	// the textarea in the browser does not preserve CRLF line endings
+	head := strings.Replace(raw[:end], "\r\n", "\n", -1)
+	head = strings.Replace(strings.TrimRight(head, "\r\n"), "\n", "\r\n", -1) + "\r\n\r\n"
+	var body []byte
+	if sep > 0 {
+		body = []byte(raw[end+sep:])
+	}
+	return head, body
+}
+
+// decodeBody removes any chunked transfer encoding from the edited body
+func decodeBody(transferEncoding []string, body []byte) ([]byte, error) {
+	if len(transferEncoding) == 0 || transferEncoding[0] != "chunked" {
+		return body, nil
+	}
+	return io.ReadAll(httputil.NewChunkedReader(bytes.NewReader(body)))
+}
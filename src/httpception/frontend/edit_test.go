@@ -0,0 +1,71 @@
+package frontend
+
+import (
+	"io"
+	"testing"
+)
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		raw  string
+		head string
+		body string
+	}{
+		{raw: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", head: "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{raw: "GET / HTTP/1.1\nHost: a\n\nbody", head: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", body: "body"},
+		{raw: "\n  GET / HTTP/1.1\r\nHost: a\r\n\r\nbody\r\n\r\nmore", head: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", body: "body\r\n\r\nmore"},
+		{raw: "GET / HTTP/1.1\nHost: a\n", head: "GET / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{raw: "GET / HTTP/1.1\nHost: a\r\n\r\nx\n\ny", head: "GET / HTTP/1.1\r\nHost: a\r\n\r\n", body: "x\n\ny"},
+	}
+	for _, test := range tests {
+		head, body := splitMessage(test.raw)
+		if head != test.head || string(body) != test.body {
+			t.Errorf("splitMessage(%q) = %q, %q, want %q, %q", test.raw, head, body, test.head, test.body)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		raw           string
+		method        string
+		url           string
+		host          string
+		body          string
+		contentLength string
+		err           bool
+	}{
+		{raw: "GET /a?b=c HTTP/1.1\nHost: example.com\n\n", method: "GET", url: "/a?b=c", host: "example.com"},
+		{raw: "POST /form HTTP/1.1\nHost: a\nContent-Length: 3\n\nedited body", method: "POST", url: "/form", host: "a", body: "edited body", contentLength: "11"},
+		{raw: "PUT /x HTTP/1.1\r\nHost: a\r\nContent-Length: 10\r\n\r\n", method: "PUT", url: "/x", host: "a", contentLength: "0"},
+		{raw: "POST /chunked HTTP/1.1\nHost: a\nTransfer-Encoding: chunked\n\n4\r\nwiki\r\n0\r\n\r\n", method: "POST", url: "/chunked", host: "a", body: "wiki", contentLength: "4"},
+		{raw: "GET http://example.com/abs HTTP/1.1\nHost: example.com\n\n", method: "GET", url: "http://example.com/abs", host: "example.com"},
+		{raw: "not a request", err: true},
+	}
+	for _, test := range tests {
+		request, err := ParseRequest(test.raw)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseRequest(%q) succeeded, want an error", test.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRequest(%q) failed: %s", test.raw, err)
+			continue
+		}
+		body, _ := io.ReadAll(request.Body)
+		if request.Method != test.method || request.RequestURI != test.url || request.Host != test.host || string(body) != test.body {
+			t.Errorf("ParseRequest(%q) = %s %s %s %q, want %s %s %s %q", test.raw,
+				request.Method, request.RequestURI, request.Host, body,
+				test.method, test.url, test.host, test.body)
+		}
+		if request.ContentLength != int64(len(test.body)) || request.Header.Get("Content-Length") != test.contentLength {
+			t.Errorf("ParseRequest(%q) has length %d and Content-Length %q, want %d and %q", test.raw,
+				request.ContentLength, request.Header.Get("Content-Length"), len(test.body), test.contentLength)
+		}
+		if len(request.TransferEncoding) > 0 || len(request.Header.Get("Transfer-Encoding")) > 0 {
+			t.Errorf("ParseRequest(%q) kept the transfer encoding", test.raw)
+		}
+	}
+}
@@ -3,43 +3,76 @@ package frontend
 import (
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
+
+	"httpception/interceptor"
+	"httpception/proxy"
 )
 
-// Frontend represents a debugging iterface
+// Frontend represents a debugging iterface, which intercepts exchanges along with the other
+// interceptors. Every call carries the ID the proxy assigned to the exchange, which ties a
+// response to its request.
 type Frontend interface {
-	InterceptRequest(*http.Request) *http.Request
-	InterceptResponse(*http.Response) *http.Response
+	interceptor.Interceptor
+	ReportUpstreamError(uint64, *http.Request, error)
+	ReportTimings(uint64, proxy.Timings)
 	Start()
+
+	// Final returns an interceptor for the end of the chain, which reports the changes
+	// the interceptors after the debugger made
+	Final() interceptor.Interceptor
 }
 
 // WebSocketFrontend represents the main web interface
 type WebSocketFrontend struct {
 	updateChan       chan UpdateInterface
 	commandChan      chan Command
+	replayChan       chan<- proxy.Replay
 	debuggingAddress string
 
 	settingsMutex    *sync.Mutex
 	debuggingEnabled bool
-	isPaused         bool
-	continueChannel  chan struct{}
+	breakPhase       BreakPhase
+	breakpoints      *breakpointList
+	pauseQueue       *pauseQueue
+	history          *History
+	ids              *proxy.IDSequence
+
+	// how long exchanges were held in the debugger, by exchange ID
+	paused map[uint64]time.Duration
+
+	// exchanges whose response should not pause, by exchange ID
+	steppedOver map[uint64]bool
+
+	// the raw request or response last reported to the debugger, by exchange ID
+	reported map[uint64]string
 }
 
 // NewWebSocketFrontend creates a new WebSocketFrontend
 func NewWebSocketFrontend(
 	updateChan chan UpdateInterface,
 	commandChan chan Command,
-	debuggingAddress string) *WebSocketFrontend {
+	replayChan chan<- proxy.Replay,
+	debuggingAddress string,
+	history *History,
+	ids *proxy.IDSequence) *WebSocketFrontend {
 	return &WebSocketFrontend{
 		updateChan:       updateChan,
 		commandChan:      commandChan,
+		replayChan:       replayChan,
 		debuggingAddress: debuggingAddress,
 		debuggingEnabled: false,
 		settingsMutex:    &sync.Mutex{},
-		continueChannel:  make(chan struct{}),
+		breakpoints:      newBreakpointList(),
+		pauseQueue:       newPauseQueue(),
+		history:          history,
+		ids:              ids,
+		paused:           make(map[uint64]time.Duration),
+		steppedOver:      make(map[uint64]bool),
+		reported:         make(map[uint64]string),
 	}
 }
 
@@ -47,8 +80,7 @@ func NewWebSocketFrontend(
 func (f *WebSocketFrontend) Start() {
 
 	// handle
-	newConnectionChan := make(chan struct{})
-	socketHandler := NewSocketHandler(f.commandChan, f.updateChan, newConnectionChan)
+	socketHandler := NewSocketHandler(f.commandChan, f.updateChan, f.history, f.initialUpdate)
 	go socketHandler.Run()
 
 	// listen for commands
@@ -57,33 +89,62 @@ func (f *WebSocketFrontend) Start() {
 			select {
 			case command := <-f.commandChan:
 				switch command.Type {
-				case ContinueCommand:
-					f.settingsMutex.Lock()
-					if f.isPaused {
-						f.settingsMutex.Unlock()
-						f.continueChannel <- struct{}{}
-					} else {
-						f.settingsMutex.Unlock()
+				case ContinueCommand, StepOverCommand, EditRequestCommand, EditResponseCommand, RespondCommand, DropCommand:
+					if !f.pauseQueue.deliver(command) {
+						f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("Nothing is paused with ID %d", command.ID))
 					}
 				case EnableDebuggingCommand:
 					f.settingsMutex.Lock()
 					f.debuggingEnabled = true
 					f.settingsMutex.Unlock()
 					f.updateChan <- NewDebuggingToggleMessage(true)
+				case ExportHARCommand:
+					har, err := ExportHAR(f.history.Entries())
+					if err != nil {
+						f.updateChan <- NewErrorUpdateMessage(err)
+						break
+					}
+					f.updateChan <- NewHARExportUpdateMessage(command.Value, har)
+				case AddBreakpointCommand:
+					breakpoint, err := ParseBreakpoint(command.Value)
+					if err != nil {
+						f.updateChan <- NewErrorUpdateMessage(err)
+						break
+					}
+					f.breakpoints.add(breakpoint)
+					f.updateChan <- NewBreakpointsUpdateMessage(f.breakpoints.list())
+				case SetBreakPhaseCommand:
+					breakPhase, err := ParseBreakPhase(command.Value)
+					if err != nil {
+						f.updateChan <- NewErrorUpdateMessage(err)
+						break
+					}
+					f.settingsMutex.Lock()
+					f.breakPhase = breakPhase
+					f.settingsMutex.Unlock()
+					f.updateChan <- NewBreakPhaseUpdateMessage(breakPhase)
+				case RemoveBreakpointCommand:
+					if !f.breakpoints.remove(command.ID) {
+						f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("No breakpoint with ID %d", command.ID))
+						break
+					}
+					f.updateChan <- NewBreakpointsUpdateMessage(f.breakpoints.list())
+				case ReplayCommand:
+					go f.replay(command)
+				case ImportHARCommand:
+					entries, err := ImportHAR([]byte(command.Value), f.ids.Next)
+					if err != nil {
+						f.updateChan <- NewErrorUpdateMessage(err)
+						break
+					}
+					f.updateChan <- NewHistoryUpdateMessage(entries)
 				case DisableDebuggingCommand:
 					f.settingsMutex.Lock()
 					f.debuggingEnabled = false
-					if f.isPaused {
-						go func() { f.continueChannel <- struct{}{} }()
-						f.isPaused = false
-					}
+					f.pauseQueue.continueAll()
 					f.settingsMutex.Unlock()
 					f.updateChan <- NewDebuggingToggleMessage(false)
 				}
-			case <-newConnectionChan:
-				f.settingsMutex.Lock()
-				f.updateChan <- NewInitialUpdateMessage(f.debuggingEnabled)
-				f.settingsMutex.Unlock()
 			}
 		}
 	}()
@@ -95,40 +156,168 @@ func (f *WebSocketFrontend) Start() {
 	http.ListenAndServe(f.debuggingAddress, nil)
 }
 
-// InterceptRequest allows the debugger to view and modify the request
-func (f *WebSocketFrontend) InterceptRequest(request *http.Request) *http.Request {
-	b, _ := httputil.DumpRequest(request, true)
-	f.updateChan <- NewRequestUpdateMessage(string(b), request.Host, request.RequestURI)
+// InterceptRequest allows the debugger to view and modify the request on its way to its
+// route, answer it without forwarding it, or drop it
+func (f *WebSocketFrontend) InterceptRequest(exchange *interceptor.Exchange) error {
+	id, route, request := exchange.ID, exchange.Route, exchange.Request
+	details := newExchangeRequestDetails(exchange)
+	breaks := f.breakpoints.matches(interceptor.RequestPhase, exchange.ClientHost, request, 0, details.Body)
+	held := f.hold(id, interceptor.RequestPhase, breaks, "["+route+"] "+details.Host+details.URL, details.Raw())
+	f.updateChan <- NewRequestUpdateMessage(id, held != nil, route, details)
 
 	// only wait for debugger command if debugging is turned on
-	if f.debuggingEnabled {
-		f.settingsMutex.Lock()
-		f.isPaused = true
-		f.settingsMutex.Unlock()
-		<-f.continueChannel
-		f.settingsMutex.Lock()
-		f.isPaused = false
-		f.settingsMutex.Unlock()
+	if held != nil {
+		defer f.release(held)
+	commandLoop:
+		for command := range held.commandChan {
+			switch command.Type {
+			case EditRequestCommand:
+				edited, err := ParseRequest(command.Value)
+				if err != nil {
+
+					// stay paused so the request can be fixed up
+					f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("Failed to parse edited request: %s", err))
+					continue
+				}
+				exchange.Request = edited
+				details = newExchangeRequestDetails(exchange)
+				f.updateChan <- NewRequestUpdateMessage(id, false, route, details)
+			case RespondCommand:
+				synthetic, err := ParseResponse(command.Value, request)
+				if err != nil {
+					f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("Failed to parse response: %s", err))
+					continue
+				}
+				f.updateChan <- NewResponseUpdateMessage(id, false, NewResponseDetails(synthetic))
+				exchange.Response = synthetic
+			case StepOverCommand:
+				f.settingsMutex.Lock()
+				f.steppedOver[id] = true
+				f.settingsMutex.Unlock()
+			case DropCommand:
+				exchange.Drop()
+			}
+			break commandLoop
+		}
 	}
-	return request
+	f.setReported(id, details.Raw())
+	return nil
 }
 
 // InterceptResponse allows the debugger to view and modify the response
-func (f *WebSocketFrontend) InterceptResponse(response *http.Response) *http.Response {
-	b, _ := httputil.DumpResponse(response, true)
-	f.updateChan <- NewResponseUpdateMessage(string(b))
+func (f *WebSocketFrontend) InterceptResponse(exchange *interceptor.Exchange) error {
+	id, response := exchange.ID, exchange.Response
+	details := NewResponseDetails(response)
+	f.settingsMutex.Lock()
+	steppedOver := f.steppedOver[id]
+	delete(f.steppedOver, id)
+	f.settingsMutex.Unlock()
+	breaks := !steppedOver && f.breakpoints.matches(interceptor.ResponsePhase, exchange.ClientHost, exchange.Request, response.StatusCode, details.Body)
+	held := f.hold(id, interceptor.ResponsePhase, breaks, response.Status, details.Raw())
+	f.updateChan <- NewResponseUpdateMessage(id, held != nil, details)
 
 	// only wait for debugger command if debugging is turned on
-	if f.debuggingEnabled {
-		f.settingsMutex.Lock()
-		f.isPaused = true
-		f.settingsMutex.Unlock()
-		<-f.continueChannel
-		f.settingsMutex.Lock()
-		f.isPaused = false
-		f.settingsMutex.Unlock()
+	if held != nil {
+		defer f.release(held)
+		for command := range held.commandChan {
+			if command.Type == EditResponseCommand {
+				edited, err := ParseResponse(command.Value, exchange.Request)
+				if err != nil {
+
+					// stay paused so the response can be fixed up
+					f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("Failed to parse edited response: %s", err))
+					continue
+				}
+				response.Body.Close()
+				exchange.Response = edited
+				details = NewResponseDetails(edited)
+				f.updateChan <- NewResponseUpdateMessage(id, false, details)
+			}
+			break
+		}
+	}
+	f.setReported(id, details.Raw())
+	return nil
+}
+
+// Final returns an interceptor for the end of the chain, which reports the changes
+// the interceptors after the debugger made
+func (f *WebSocketFrontend) Final() interceptor.Interceptor {
+	return interceptor.Funcs{
+		Request: func(exchange *interceptor.Exchange) error {
+			details := newExchangeRequestDetails(exchange)
+			if f.takeReported(exchange.ID) != details.Raw() {
+				f.updateChan <- NewRequestUpdateMessage(exchange.ID, false, exchange.Route, details)
+			}
+			return nil
+		},
+		Response: func(exchange *interceptor.Exchange) error {
+			details := NewResponseDetails(exchange.Response)
+			if f.takeReported(exchange.ID) != details.Raw() {
+				f.updateChan <- NewResponseUpdateMessage(exchange.ID, false, details)
+			}
+			return nil
+		},
 	}
-	return response
+}
+
+// ReportUpstreamError tells the debugger that a request could not be forwarded
+func (f *WebSocketFrontend) ReportUpstreamError(id uint64, request *http.Request, err error) {
+	f.updateChan <- NewUpstreamErrorUpdateMessage(id, request.Host, request.URL.RequestURI(), err)
+}
+
+// ReportTimings tells the debugger where the time of a finished exchange went, adding
+// the time it was held
+func (f *WebSocketFrontend) ReportTimings(id uint64, timings proxy.Timings) {
+	f.settingsMutex.Lock()
+	timings.Paused = f.paused[id]
+	delete(f.paused, id)
+	delete(f.reported, id)
+	f.settingsMutex.Unlock()
+	f.updateChan <- NewTimingsUpdateMessage(id, timings)
+}
+
+// setReported remembers what the debugger was last told about an exchange
+func (f *WebSocketFrontend) setReported(id uint64, raw string) {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	f.reported[id] = raw
+}
+
+// takeReported returns what the debugger was last told about an exchange, and forgets it
+func (f *WebSocketFrontend) takeReported(id uint64) string {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	raw := f.reported[id]
+	delete(f.reported, id)
+	return raw
+}
+
+// initialUpdate tells a newly joined client about the debugger state and the history
+func (f *WebSocketFrontend) initialUpdate() UpdateInterface {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	return NewInitialUpdateMessage(f.debuggingEnabled, f.breakPhase, f.breakpoints.list(), f.pauseQueue.list(), f.history.Entries())
+}
+
+// hold queues an intercepted request or response until the debugger sends a command
+// for it, if debugging is turned on and it hit a breakpoint
+func (f *WebSocketFrontend) hold(id uint64, phase interceptor.Phase, breaks bool, summary string, message string) *heldExchange {
+	f.settingsMutex.Lock()
+	defer f.settingsMutex.Unlock()
+	if !f.debuggingEnabled || !f.breakPhase.includes(phase) || !breaks {
+		return nil
+	}
+	return f.pauseQueue.hold(id, phase, summary, message)
+}
+
+// release lets a held request or response continue
+func (f *WebSocketFrontend) release(held *heldExchange) {
+	f.pauseQueue.release(held)
+	f.settingsMutex.Lock()
+	f.paused[held.ExchangeID] += time.Since(held.since)
+	f.settingsMutex.Unlock()
+	f.updateChan <- NewResumedUpdateMessage(held.ExchangeID, held.Phase)
 }
 
 var _ = Frontend(&WebSocketFrontend{})
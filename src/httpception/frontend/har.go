@@ -0,0 +1,376 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"httpception/proxy"
+)
+
+// harRoute is the route shown for exchanges imported from a HAR file
+const harRoute = "har"
+
+// the subset of HTTP Archive 1.2 (http://www.softwareishard.com/blog/har-12-spec/) that is used here
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// harTimings are in milliseconds, -1 for phases that did not happen. Connect includes SSL.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+
+	// HAR has no notion of a debugger, so this is a custom field
+	Paused float64 `json:"_paused"`
+}
+
+// ExportHAR converts history entries to an HTTP Archive
+func ExportHAR(entries []HistoryEntry) ([]byte, error) {
+	file := harFile{
+		Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "httpception", Version: "1.0"},
+			Entries: make([]harEntry, 0, len(entries)),
+		},
+	}
+	for _, entry := range entries {
+		harEntry, err := newHAREntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to export exchange %d: %s", entry.ID, err)
+		}
+		file.Log.Entries = append(file.Log.Entries, harEntry)
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// ImportHAR converts an HTTP Archive to history entries, numbering them with nextID
+func ImportHAR(data []byte, nextID func() uint64) ([]HistoryEntry, error) {
+	var file harFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Failed to parse HAR: %s", err)
+	}
+	entries := make([]HistoryEntry, 0, len(file.Log.Entries))
+	for i, harEntry := range file.Log.Entries {
+		entry, err := newHistoryEntry(harEntry)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to import HAR entry %d: %s", i, err)
+		}
+		entry.ID = nextID()
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func newHAREntry(entry HistoryEntry) (harEntry, error) {
+	request := entry.Request
+
+	// requests that went through a forward proxy already carry an absolute URL, the others
+	// are addressed to what the client asked for, which entries from older histories lack
+	requestURL, err := url.Parse(request.URL)
+	if err != nil {
+		return harEntry{}, err
+	}
+	if len(requestURL.Host) == 0 {
+		requestURL.Scheme, requestURL.Host = request.Scheme, request.ClientHost
+		if len(requestURL.Scheme) == 0 {
+			requestURL.Scheme = "http"
+		}
+		if len(requestURL.Host) == 0 {
+			requestURL.Host = request.Host
+		}
+	}
+	result := harEntry{
+		StartedDateTime: entry.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            milliseconds(entry.Timings.Total),
+		Timings:         newHARTimings(entry.Timings),
+		Request: harRequest{
+			Method:      request.Method,
+			URL:         requestURL.String(),
+			HTTPVersion: request.Proto,
+			Cookies:     harCookies((&http.Request{Header: request.Header}).Cookies()),
+			Headers:     harHeaders(request.Header),
+			QueryString: harQuery(requestURL.Query()),
+			HeadersSize: request.HeadersSize,
+			BodySize:    request.BodySize,
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+	if len(request.Body) > 0 {
+		result.Request.PostData = &harPostData{
+			MimeType: request.ContentType,
+			Text:     string(request.Body),
+		}
+	}
+
+	// exchanges that were dropped have no response
+	response := entry.Response
+	if response == nil {
+		return result, nil
+	}
+	result.Response = harResponse{
+		Status:      response.StatusCode,
+		StatusText:  http.StatusText(response.StatusCode),
+		HTTPVersion: response.Proto,
+		Cookies:     harCookies((&http.Response{Header: response.Header}).Cookies()),
+		Headers:     harHeaders(response.Header),
+		Content: harContent{
+			Size:     response.BodySize,
+			MimeType: response.ContentType,
+		},
+		RedirectURL: response.Header.Get("Location"),
+		HeadersSize: response.HeadersSize,
+		BodySize:    response.BodySize,
+	}
+	if utf8.Valid(response.Body) {
+		result.Response.Content.Text = string(response.Body)
+	} else {
+		result.Response.Content.Text = base64.StdEncoding.EncodeToString(response.Body)
+		result.Response.Content.Encoding = "base64"
+	}
+	return result, nil
+}
+
+func newHistoryEntry(entry harEntry) (HistoryEntry, error) {
+	requestURL, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	started, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+	if err != nil {
+		started = time.Now()
+	}
+
+	// the body of a HAR request is never encoded
+	var requestBody []byte
+	if entry.Request.PostData != nil {
+		requestBody = []byte(entry.Request.PostData.Text)
+	}
+	request := &http.Request{
+		Method:     entry.Request.Method,
+		URL:        requestURL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     httpHeader(entry.Request.Headers, len(requestBody)),
+		Host:       requestURL.Host,
+		RequestURI: requestURL.RequestURI(),
+	}
+	request.Body = io.NopCloser(bytes.NewReader(requestBody))
+	request.ContentLength = int64(len(requestBody))
+	requestDetails := NewRequestDetails(request)
+	requestDetails.Scheme, requestDetails.ClientHost = requestURL.Scheme, requestURL.Host
+	result := HistoryEntry{
+		Route:   harRoute,
+		Request: requestDetails,
+		Time:    started,
+		Timings: newTimings(entry.Time, entry.Timings),
+	}
+
+	// browsers record requests that never got a response with status 0
+	if entry.Response.Status == 0 {
+		return result, nil
+	}
+	responseBody := []byte(entry.Response.Content.Text)
+	if entry.Response.Content.Encoding == "base64" {
+		if responseBody, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+			return HistoryEntry{}, err
+		}
+	}
+	response := &http.Response{
+		Status:     strconv.Itoa(entry.Response.Status) + " " + http.StatusText(entry.Response.Status),
+		StatusCode: entry.Response.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     httpHeader(entry.Response.Headers, len(responseBody)),
+		Request:    request,
+	}
+	response.Body = io.NopCloser(bytes.NewReader(responseBody))
+	response.ContentLength = int64(len(responseBody))
+	details := NewResponseDetails(response)
+	result.Response = &details
+	return result, nil
+}
+
+func newHARTimings(timings proxy.Timings) harTimings {
+	result := harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+		Wait:    milliseconds(timings.TimeToFirstByte),
+		Receive: milliseconds(timings.Transfer),
+		Paused:  milliseconds(timings.Paused),
+	}
+	if !timings.ConnectionReused && timings.Connect > 0 {
+		result.DNS = milliseconds(timings.DNS)
+		result.Connect = milliseconds(timings.Connect + timings.TLSHandshake)
+		if timings.TLSHandshake > 0 {
+			result.SSL = milliseconds(timings.TLSHandshake)
+		}
+	}
+	return result
+}
+
+func newTimings(total float64, timings harTimings) proxy.Timings {
+	result := proxy.Timings{
+		TimeToFirstByte:  duration(timings.Wait),
+		Transfer:         duration(timings.Receive),
+		Paused:           duration(timings.Paused),
+		Total:            duration(total),
+		ConnectionReused: timings.Connect < 0,
+	}
+	if timings.Connect >= 0 {
+		result.DNS = duration(timings.DNS)
+		result.TLSHandshake = duration(timings.SSL)
+		result.Connect = duration(timings.Connect) - result.TLSHandshake
+	}
+	return result
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// duration converts HAR milliseconds, where -1 means the phase did not happen
+func duration(ms float64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// httpHeader converts HAR headers, which describe the body as it was on the wire, to
+// headers for the decoded body that HAR files hold
+func httpHeader(headers []harNameValue, bodySize int) http.Header {
+	header := http.Header{}
+	for _, h := range headers {
+
+		// HTTP/2 pseudo headers are not headers in HTTP/1.1
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		header.Add(h.Name, h.Value)
+	}
+	for _, name := range []string{"Content-Encoding", "Content-Length", "Transfer-Encoding"} {
+		header.Del(name)
+	}
+	if bodySize > 0 {
+		header.Set("Content-Length", strconv.Itoa(bodySize))
+	}
+	return header
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := make([]harNameValue, 0, len(header))
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harQuery(query url.Values) []harNameValue {
+	params := make([]harNameValue, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, harNameValue{Name: name, Value: value})
+		}
+	}
+	return params
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	result := make([]harNameValue, 0, len(cookies))
+	for _, cookie := range cookies {
+		result = append(result, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return result
+}
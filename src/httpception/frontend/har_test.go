@@ -0,0 +1,171 @@
+package frontend
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"httpception/proxy"
+)
+
+func TestHARRoundTrip(t *testing.T) {
+	started := time.Date(2024, 3, 1, 12, 30, 0, 250*int(time.Millisecond), time.UTC)
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		scheme       string
+		clientHost   string
+		exportedURL  string
+		requestBody  string
+		header       http.Header
+		status       int
+		responseBody []byte
+		timings      proxy.Timings
+	}{
+		{
+			name:         "get",
+			method:       "GET",
+			url:          "http://example.com/search?q=go&page=2",
+			exportedURL:  "http://example.com/search?q=go&page=2",
+			header:       http.Header{"Accept": {"text/html"}, "Cookie": {"session=abc"}},
+			status:       http.StatusOK,
+			responseBody: []byte("<html></html>"),
+			timings:      proxy.Timings{ConnectionReused: true, TimeToFirstByte: 20 * time.Millisecond, Transfer: 5 * time.Millisecond, Total: 25 * time.Millisecond},
+		},
+		{
+			name:         "post",
+			method:       "POST",
+			url:          "http://api.example.com/orders",
+			exportedURL:  "http://api.example.com/orders",
+			requestBody:  `{"item": 1}`,
+			header:       http.Header{"Content-Type": {"application/json"}},
+			status:       http.StatusCreated,
+			responseBody: []byte(`{"id": 7}`),
+			timings:      proxy.Timings{DNS: 2 * time.Millisecond, Connect: 3 * time.Millisecond, TLSHandshake: 4 * time.Millisecond, TimeToFirstByte: 10 * time.Millisecond, Paused: 100 * time.Millisecond, Total: 120 * time.Millisecond},
+		},
+		{
+			name:         "binary",
+			method:       "GET",
+			url:          "http://example.com/logo.png",
+			exportedURL:  "http://example.com/logo.png",
+			header:       http.Header{},
+			status:       http.StatusOK,
+			responseBody: []byte{0x89, 'P', 'N', 'G', 0xff, 0x00},
+			timings:      proxy.Timings{ConnectionReused: true},
+		},
+		{
+			name:        "dropped",
+			method:      "DELETE",
+			url:         "http://example.com/orders/7",
+			exportedURL: "http://example.com/orders/7",
+			header:      http.Header{"Authorization": {"Bearer token"}},
+			timings:     proxy.Timings{ConnectionReused: true},
+		},
+		{
+			name:         "https",
+			method:       "GET",
+			url:          "http://localhost:4444/account?tab=keys",
+			scheme:       "https",
+			clientHost:   "secure.example.com",
+			exportedURL:  "https://secure.example.com/account?tab=keys",
+			header:       http.Header{},
+			status:       http.StatusOK,
+			responseBody: []byte("keys"),
+			timings:      proxy.Timings{Connect: 12 * time.Millisecond, TLSHandshake: 8 * time.Millisecond, Total: 30 * time.Millisecond},
+		},
+	}
+
+	entries := make([]HistoryEntry, 0, len(tests))
+	for i, test := range tests {
+		request := httptest.NewRequest(test.method, test.url, strings.NewReader(test.requestBody))
+		request.Header = test.header.Clone()
+
+		// as sent by a client, not through a forward proxy
+		request.RequestURI = request.URL.RequestURI()
+		details := NewRequestDetails(request)
+		details.Scheme, details.ClientHost = test.scheme, test.clientHost
+		entry := HistoryEntry{
+			ID:      uint64(i + 1),
+			Route:   "default",
+			Request: details,
+			Time:    started,
+			Timings: test.timings,
+		}
+		if test.status != 0 {
+			response := &http.Response{
+				StatusCode: test.status,
+				Proto:      "HTTP/1.1",
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"X-Test": {test.name}},
+				Body:       io.NopCloser(bytes.NewReader(test.responseBody)),
+				Request:    request,
+			}
+			details := NewResponseDetails(response)
+			entry.Response = &details
+		}
+		entries = append(entries, entry)
+	}
+
+	har, err := ExportHAR(entries)
+	if err != nil {
+		t.Fatalf("ExportHAR failed: %s", err)
+	}
+	nextID := uint64(100)
+	imported, err := ImportHAR(har, func() uint64 {
+		nextID++
+		return nextID
+	})
+	if err != nil {
+		t.Fatalf("ImportHAR failed: %s", err)
+	}
+	if len(imported) != len(tests) {
+		t.Fatalf("imported %d entries, want %d", len(imported), len(tests))
+	}
+
+	for i, test := range tests {
+		entry, original := imported[i], entries[i]
+		if url := entry.Request.Scheme + "://" + entry.Request.ClientHost + entry.Request.URL; url != test.exportedURL {
+			t.Errorf("%s: imported %s, want %s", test.name, url, test.exportedURL)
+		}
+		if entry.ID != uint64(101+i) || entry.Route != harRoute || !entry.Time.Equal(started) {
+			t.Errorf("%s: imported #%d on route %q at %s", test.name, entry.ID, entry.Route, entry.Time)
+		}
+		request := entry.Request
+		if request.Method != test.method || request.URL != original.Request.URL || string(request.Body) != test.requestBody {
+			t.Errorf("%s: imported request %s %s %q, want %s %s %q", test.name,
+				request.Method, request.URL, request.Body,
+				test.method, original.Request.URL, test.requestBody)
+		}
+		for name := range test.header {
+			if !reflect.DeepEqual(request.Header[name], test.header[name]) {
+				t.Errorf("%s: imported request header %s = %v, want %v", test.name, name, request.Header[name], test.header[name])
+			}
+		}
+		if entry.Timings != test.timings {
+			t.Errorf("%s: imported timings %+v, want %+v", test.name, entry.Timings, test.timings)
+		}
+
+		if test.status == 0 {
+			if entry.Response != nil {
+				t.Errorf("%s: imported a response for a dropped exchange", test.name)
+			}
+			continue
+		}
+		response := entry.Response
+		if response == nil {
+			t.Errorf("%s: imported no response", test.name)
+			continue
+		}
+		if response.StatusCode != test.status || !bytes.Equal(response.Body, test.responseBody) || response.Header.Get("X-Test") != test.name {
+			t.Errorf("%s: imported response %d %q %v, want %d %q", test.name,
+				response.StatusCode, response.Body, response.Header, test.status, test.responseBody)
+		}
+	}
+}
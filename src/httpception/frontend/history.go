@@ -0,0 +1,317 @@
+package frontend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"httpception/proxy"
+)
+
+// HistoryEntry is a request that passed through the proxy and, once it arrived, its response
+type HistoryEntry struct {
+	ID    uint64
+	Route string
+
+	// the ID of the exchange this one replays, 0 if it came from a client
+	ReplayOf uint64
+	Request  RequestDetails
+	Time     time.Time
+
+	// nil until the response arrives, and for requests that were dropped
+	Response *ResponseDetails
+	Timings  proxy.Timings
+}
+
+// historyCompactFactor is how many times the capacity of the history its file may grow to
+// in lines before it is compacted
+const historyCompactFactor = 4
+
+// historyWriteQueue is how many writes may wait for the history file before recording an
+// exchange waits for the disk
+const historyWriteQueue = 1024
+
+// historyWrite is a line to append to the history file, or the lines of the entries that
+// are kept to replace it with
+type historyWrite struct {
+	lines   [][]byte
+	replace bool
+}
+
+// History keeps the most recent exchanges in a ring buffer, optionally backed by a file
+type History struct {
+	lock    *sync.Mutex
+	entries []*HistoryEntry
+	start   int
+	count   int
+	byID    map[uint64]*HistoryEntry
+	lastID  uint64
+
+	// the number of lines written to the file since it was compacted, and the writes
+	// queued for the goroutine that owns the file
+	path   string
+	lines  int
+	writes chan historyWrite
+	done   chan struct{}
+}
+
+// NewHistory creates a history of at most capacity exchanges. If path is not empty the
+// exchanges recorded there are loaded, and new ones are appended to it.
+func NewHistory(capacity int, path string) (*History, error) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	h := &History{
+		lock:    &sync.Mutex{},
+		entries: make([]*HistoryEntry, capacity),
+		byID:    make(map[uint64]*HistoryEntry),
+	}
+	if len(path) == 0 {
+		return h, nil
+	}
+	file, err := h.load(path)
+	if err != nil {
+		return nil, err
+	}
+	h.writes = make(chan historyWrite, historyWriteQueue)
+	h.done = make(chan struct{})
+	go h.write(file, h.writes)
+	return h, nil
+}
+
+// Close writes the lines that are still queued and closes the history file, exchanges
+// recorded afterwards are only kept in memory
+func (h *History) Close() {
+	h.lock.Lock()
+	writes := h.writes
+	h.writes = nil
+	h.lock.Unlock()
+	if writes == nil {
+		return
+	}
+	close(writes)
+	<-h.done
+}
+
+// AddRequest records a new exchange, or the edited request of one that is in the history
+func (h *History) AddRequest(message RequestUpdateMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if entry, ok := h.byID[message.ExchangeID]; ok {
+		entry.Route = message.Route
+		entry.Request = message.Request
+		h.persist(entry)
+		return
+	}
+	entry := &HistoryEntry{
+		ID:       message.ExchangeID,
+		Route:    message.Route,
+		ReplayOf: message.ReplayOf,
+		Request:  message.Request,
+		Time:     message.Time,
+	}
+	h.push(entry)
+	h.persist(entry)
+}
+
+// AddResponse records the response of an exchange, or its edited response, if the exchange
+// is still in the history
+func (h *History) AddResponse(message ResponseUpdateMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry, ok := h.byID[message.ExchangeID]
+	if !ok {
+		return
+	}
+	response := message.Response
+	entry.Response = &response
+	h.persist(entry)
+}
+
+// AddTimings records where the time of an exchange went, if it is still in the history
+func (h *History) AddTimings(message TimingsUpdateMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry, ok := h.byID[message.ExchangeID]
+	if !ok {
+		return
+	}
+	entry.Timings = message.Timings
+	h.persist(entry)
+}
+
+// Add records exchanges that were not seen by the proxy, such as imported ones
+func (h *History) Add(entries ...HistoryEntry) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := range entries {
+		entry := entries[i]
+		h.push(&entry)
+		h.persist(&entry)
+	}
+}
+
+// Entry returns the exchange with an ID, if it is still in the history
+func (h *History) Entry(id uint64) (HistoryEntry, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entry, ok := h.byID[id]
+	if !ok {
+		return HistoryEntry{}, false
+	}
+	return *entry, true
+}
+
+// Entries returns the exchanges in the history, oldest first
+func (h *History) Entries() []HistoryEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	entries := make([]HistoryEntry, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		entries = append(entries, *h.entries[(h.start+i)%len(h.entries)])
+	}
+	return entries
+}
+
+// LastID returns the highest exchange ID ever recorded, so new IDs do not clash with loaded ones
+func (h *History) LastID() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.lastID
+}
+
+// push adds an entry, overwriting the oldest one once the history is full
+func (h *History) push(entry *HistoryEntry) {
+	if h.count == len(h.entries) {
+		delete(h.byID, h.entries[h.start].ID)
+		h.entries[h.start] = entry
+		h.start = (h.start + 1) % len(h.entries)
+	} else {
+		h.entries[(h.start+h.count)%len(h.entries)] = entry
+		h.count++
+	}
+	h.byID[entry.ID] = entry
+	if entry.ID > h.lastID {
+		h.lastID = entry.ID
+	}
+}
+
+// persist queues an entry to be appended to the history file. Entries are written again
+// when they change, and the last line for an ID wins when the file is loaded.
+func (h *History) persist(entry *HistoryEntry) {
+	if h.writes == nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("\n[ERROR] Failed to encode history entry: %v", err)
+		return
+	}
+	h.writes <- historyWrite{lines: [][]byte{append(b, '\n')}}
+	h.lines++
+
+	// compact the file once it grew too long, so it does not grow forever
+	if h.lines >= historyCompactFactor*len(h.entries) {
+		lines, err := h.keptLines()
+		if err != nil {
+			fmt.Printf("\n[ERROR] %v", err)
+			return
+		}
+		h.writes <- historyWrite{lines: lines, replace: true}
+		h.lines = len(lines)
+	}
+}
+
+// write carries out the queued writes until the history is closed
+func (h *History) write(file *os.File, writes <-chan historyWrite) {
+	for write := range writes {
+		if write.replace {
+			replaced, err := h.replace(write.lines)
+			if err != nil {
+				fmt.Printf("\n[ERROR] %v", err)
+				continue
+			}
+			file.Close()
+			file = replaced
+			continue
+		}
+		if _, err := file.Write(write.lines[0]); err != nil {
+			fmt.Printf("\n[ERROR] Failed to write history: %v", err)
+		}
+	}
+	file.Close()
+	close(h.done)
+}
+
+// keptLines encodes the entries that are kept, oldest first
+func (h *History) keptLines() ([][]byte, error) {
+	lines := make([][]byte, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		b, err := json.Marshal(h.entries[(h.start+i)%len(h.entries)])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode history entry: %s", err)
+		}
+		lines = append(lines, append(b, '\n'))
+	}
+	return lines, nil
+}
+
+// replace replaces the history file with one that holds only the given lines, and returns
+// it so new entries are appended to it
+func (h *History) replace(lines [][]byte) (*os.File, error) {
+	temp := h.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compact history: %s", err)
+	}
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		writer.Write(line)
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to compact history: %s", err)
+	}
+	if err := os.Rename(temp, h.path); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to compact history: %s", err)
+	}
+	return file, nil
+}
+
+// load reads the entries of a history file and rewrites it with only the entries that are
+// kept, returning it so new entries are appended to it
+func (h *History) load(path string) (*os.File, error) {
+	h.path = path
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("Failed to parse history in %s: %s", path, err)
+			}
+			if existing, ok := h.byID[entry.ID]; ok {
+				*existing = entry
+			} else {
+				h.push(&entry)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("Failed to read history from %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to open history: %s", err)
+	}
+	lines, err := h.keptLines()
+	if err != nil {
+		return nil, err
+	}
+	h.lines = len(lines)
+	return h.replace(lines)
+}
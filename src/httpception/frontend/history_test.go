@@ -0,0 +1,163 @@
+package frontend
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"httpception/proxy"
+)
+
+// recordExchange adds an exchange to the history the way the socket handler does
+func recordExchange(history *History, id uint64, url string) {
+	history.AddRequest(NewRequestUpdateMessage(id, false, "default", RequestDetails{Method: "GET", URL: url}))
+	history.AddResponse(NewResponseUpdateMessage(id, false, ResponseDetails{StatusCode: 200, Status: "200 OK"}))
+}
+
+func historyIDs(history *History) []uint64 {
+	ids := make([]uint64, 0)
+	for _, entry := range history.Entries() {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	return lines
+}
+
+func TestHistoryEviction(t *testing.T) {
+	tests := []struct {
+		capacity int
+		ids      []uint64
+		kept     []uint64
+		lastID   uint64
+	}{
+		{capacity: 3, ids: []uint64{}, kept: []uint64{}},
+		{capacity: 3, ids: []uint64{1, 2}, kept: []uint64{1, 2}, lastID: 2},
+		{capacity: 3, ids: []uint64{1, 2, 3, 4, 5}, kept: []uint64{3, 4, 5}, lastID: 5},
+		{capacity: 1, ids: []uint64{7, 8}, kept: []uint64{8}, lastID: 8},
+		{capacity: 0, ids: []uint64{1, 2}, kept: []uint64{2}, lastID: 2},
+		{capacity: 3, ids: []uint64{5, 2}, kept: []uint64{5, 2}, lastID: 5},
+	}
+	for _, test := range tests {
+		history, err := NewHistory(test.capacity, "")
+		if err != nil {
+			t.Fatalf("NewHistory failed: %s", err)
+		}
+		for _, id := range test.ids {
+			recordExchange(history, id, "/")
+		}
+		if ids := historyIDs(history); !reflect.DeepEqual(ids, test.kept) {
+			t.Errorf("capacity %d after %v kept %v, want %v", test.capacity, test.ids, ids, test.kept)
+		}
+		if history.LastID() != test.lastID {
+			t.Errorf("capacity %d after %v has last ID %d, want %d", test.capacity, test.ids, history.LastID(), test.lastID)
+		}
+
+		// evicted exchanges are gone, so their late responses are ignored
+		if len(test.ids) > len(test.kept) {
+			evicted := test.ids[0]
+			history.AddTimings(NewTimingsUpdateMessage(evicted, proxy.Timings{}))
+			if _, ok := history.Entry(evicted); ok {
+				t.Errorf("capacity %d still has evicted exchange %d", test.capacity, evicted)
+			}
+		}
+	}
+}
+
+func TestHistoryLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := NewHistory(3, path)
+	if err != nil {
+		t.Fatalf("NewHistory failed: %s", err)
+	}
+	for id := uint64(1); id <= 4; id++ {
+		recordExchange(history, id, "/original")
+	}
+
+	// an edited request is written again, and wins when the file is loaded
+	history.AddRequest(NewRequestUpdateMessage(3, false, "edited", RequestDetails{Method: "POST", URL: "/edited"}))
+	history.Close()
+
+	loaded, err := NewHistory(3, path)
+	if err != nil {
+		t.Fatalf("loading the history failed: %s", err)
+	}
+	defer loaded.Close()
+	if ids := historyIDs(loaded); !reflect.DeepEqual(ids, []uint64{2, 3, 4}) {
+		t.Errorf("loaded %v, want [2 3 4]", ids)
+	}
+	if loaded.LastID() != 4 {
+		t.Errorf("loaded last ID %d, want 4", loaded.LastID())
+	}
+	entry, _ := loaded.Entry(3)
+	if entry.Route != "edited" || entry.Request.URL != "/edited" || entry.Response == nil || entry.Response.StatusCode != 200 {
+		t.Errorf("loaded %+v, want the edited request with its response", entry)
+	}
+
+	// loading rewrites the file with only the entries that are kept
+	if lines := countLines(t, path); lines != 3 {
+		t.Errorf("history file has %d lines after loading, want 3", lines)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("history file has mode %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	tests := []struct {
+		capacity  int
+		exchanges int
+		maxLines  int
+	}{
+		{capacity: 2, exchanges: 1, maxLines: 2},
+		{capacity: 2, exchanges: 10, maxLines: historyCompactFactor * 2},
+		{capacity: 5, exchanges: 100, maxLines: historyCompactFactor * 5},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "history.jsonl")
+		history, err := NewHistory(test.capacity, path)
+		if err != nil {
+			t.Fatalf("NewHistory failed: %s", err)
+		}
+		for id := 1; id <= test.exchanges; id++ {
+			recordExchange(history, uint64(id), "/")
+		}
+		history.Close()
+
+		if lines := countLines(t, path); lines > test.maxLines {
+			t.Errorf("capacity %d after %d exchanges has %d lines, want at most %d", test.capacity, test.exchanges, lines, test.maxLines)
+		}
+		loaded, err := NewHistory(test.capacity, path)
+		if err != nil {
+			t.Fatalf("loading the history failed: %s", err)
+		}
+		kept := test.exchanges
+		if kept > test.capacity {
+			kept = test.capacity
+		}
+		if ids := historyIDs(loaded); len(ids) != kept || ids[kept-1] != uint64(test.exchanges) {
+			t.Errorf("capacity %d after %d exchanges loaded %v", test.capacity, test.exchanges, ids)
+		}
+		loaded.Close()
+
+		// exchanges recorded after closing are only kept in memory
+		lines := countLines(t, path)
+		recordExchange(loaded, uint64(test.exchanges+1), "/")
+		if countLines(t, path) != lines {
+			t.Errorf("capacity %d wrote to the history file after it was closed", test.capacity)
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package frontend
 
+import (
+	"time"
+
+	"httpception/interceptor"
+	"httpception/proxy"
+)
+
 // CommandType is the type of command
 type CommandType uint
 
@@ -13,6 +20,43 @@ const (
 
 	// ContinueCommand is a command from the front end to go to the next step
 	ContinueCommand = iota
+
+	// EditRequestCommand is a command from the front end to forward an edited request
+	EditRequestCommand = iota
+
+	// EditResponseCommand is a command from the front end to return an edited response
+	EditResponseCommand = iota
+
+	// RespondCommand is a command from the front end to answer a paused request without forwarding it
+	RespondCommand = iota
+
+	// DropCommand is a command from the front end to abort a paused request
+	DropCommand = iota
+
+	// ExportHARCommand is a command from the front end to export the history as HAR,
+	// the value is echoed back with the export
+	ExportHARCommand = iota
+
+	// ImportHARCommand is a command from the front end to add the exchanges of a HAR file to the history
+	ImportHARCommand = iota
+
+	// ReplayCommand is a command from the front end to send the request of the exchange
+	// with the ID again, replaced by the value if it is not empty
+	ReplayCommand = iota
+
+	// AddBreakpointCommand is a command from the front end to set the breakpoint in the value
+	AddBreakpointCommand = iota
+
+	// RemoveBreakpointCommand is a command from the front end to remove the breakpoint with the ID
+	RemoveBreakpointCommand = iota
+
+	// SetBreakPhaseCommand is a command from the front end to choose in which phases the
+	// debugger pauses, the value is both, request or response
+	SetBreakPhaseCommand = iota
+
+	// StepOverCommand is a command from the front end to continue a paused request without
+	// pausing its response
+	StepOverCommand = iota
 )
 
 // CommandInterface is the interface for commands received from the user interface
@@ -21,6 +65,10 @@ type CommandInterface interface{}
 // Command represents a command from the client
 type Command struct {
 	Type CommandType
+
+	// the exchange the command targets
+	ID    uint64
+	Value string
 }
 
 // UpdateType is the type of update message for the frontend
@@ -39,8 +87,40 @@ const (
 
 	// InitialUpdate tells a newly joined client everything he needs to know
 	InitialUpdate = iota
+
+	// ErrorUpdate tells the client that a command could not be applied
+	ErrorUpdate = iota
+
+	// ResumedUpdate tells the client that a held request or response continued
+	ResumedUpdate = iota
+
+	// UpstreamErrorUpdate tells the client that a request could not be forwarded
+	UpstreamErrorUpdate = iota
+
+	// HistoryUpdate adds exchanges that were not seen by the proxy to the history
+	HistoryUpdate = iota
+
+	// HARExportUpdate sends the history as HAR to the client that asked for it
+	HARExportUpdate = iota
+
+	// TimingsUpdate tells the client where the time of a finished exchange went
+	TimingsUpdate = iota
+
+	// BreakpointsUpdate tells the client which breakpoints are set
+	BreakpointsUpdate = iota
+
+	// BreakPhaseUpdate tells the client in which phases the debugger pauses
+	BreakPhaseUpdate = iota
 )
 
+// HeldExchange describes a request or response held by the debugger
+type HeldExchange struct {
+	ExchangeID uint64
+	Phase      interceptor.Phase
+	Summary    string
+	Message    string
+}
+
 // UpdateInterface represents an update message
 type UpdateInterface interface{}
 
@@ -48,49 +128,64 @@ type UpdateInterface interface{}
 type InitialUpdateMessage struct {
 	Type             UpdateType
 	DebuggingEnabled bool
+	BreakPhase       BreakPhase
+	Breakpoints      []Breakpoint
+	Held             []HeldExchange
+	History          []HistoryEntry
 }
 
 // NewInitialUpdateMessage creates a new update message
-func NewInitialUpdateMessage(debuggingEnabled bool) InitialUpdateMessage {
+func NewInitialUpdateMessage(debuggingEnabled bool, breakPhase BreakPhase, breakpoints []Breakpoint, held []HeldExchange, history []HistoryEntry) InitialUpdateMessage {
 	return InitialUpdateMessage{
 		Type:             InitialUpdate,
 		DebuggingEnabled: debuggingEnabled,
+		BreakPhase:       breakPhase,
+		Breakpoints:      breakpoints,
+		Held:             held,
+		History:          history,
 	}
 }
 
 // RequestUpdateMessage represents a new request update
 type RequestUpdateMessage struct {
-	Type UpdateType
+	Type       UpdateType
+	ExchangeID uint64
+	Paused     bool
 
-	//TODO: decompose this
-	Request    string
-	RequestURI string
-	Host       string
+	// the ID of the exchange this request replays, 0 if it came from a client
+	ReplayOf uint64
+	Route    string
+	Request  RequestDetails
+	Time     time.Time
 }
 
 // NewRequestUpdateMessage creates a new update
-func NewRequestUpdateMessage(request string, host string, requestURI string) RequestUpdateMessage {
+func NewRequestUpdateMessage(exchangeID uint64, paused bool, route string, request RequestDetails) RequestUpdateMessage {
 	return RequestUpdateMessage{
 		Type:       RequestUpdate,
+		ExchangeID: exchangeID,
+		Paused:     paused,
+		Route:      route,
 		Request:    request,
-		RequestURI: requestURI,
-		Host:       host,
+		Time:       time.Now(),
 	}
 }
 
-// ResponseUpdateMessage represents a new request update
+// ResponseUpdateMessage represents a new response update
 type ResponseUpdateMessage struct {
-	Type UpdateType
-
-	//TODO: decompose this
-	Response string
+	Type       UpdateType
+	ExchangeID uint64
+	Paused     bool
+	Response   ResponseDetails
 }
 
 // NewResponseUpdateMessage creates a new update
-func NewResponseUpdateMessage(response string) ResponseUpdateMessage {
+func NewResponseUpdateMessage(exchangeID uint64, paused bool, response ResponseDetails) ResponseUpdateMessage {
 	return ResponseUpdateMessage{
-		Type:     ResponseUpdate,
-		Response: response,
+		Type:       ResponseUpdate,
+		ExchangeID: exchangeID,
+		Paused:     paused,
+		Response:   response,
 	}
 }
 
@@ -107,3 +202,127 @@ func NewDebuggingToggleMessage(debuggingEnabled bool) DebuggingToggleMessage {
 		DebuggingEnabled: debuggingEnabled,
 	}
 }
+
+// ErrorUpdateMessage tells the client that a command could not be applied
+type ErrorUpdateMessage struct {
+	Type  UpdateType
+	Error string
+}
+
+// NewErrorUpdateMessage creates a new ErrorUpdateMessage
+func NewErrorUpdateMessage(err error) ErrorUpdateMessage {
+	return ErrorUpdateMessage{
+		Type:  ErrorUpdate,
+		Error: err.Error(),
+	}
+}
+
+// ResumedUpdateMessage tells the client that a held request or response continued
+type ResumedUpdateMessage struct {
+	Type       UpdateType
+	ExchangeID uint64
+	Phase      interceptor.Phase
+}
+
+// NewResumedUpdateMessage creates a new ResumedUpdateMessage
+func NewResumedUpdateMessage(exchangeID uint64, phase interceptor.Phase) ResumedUpdateMessage {
+	return ResumedUpdateMessage{
+		Type:       ResumedUpdate,
+		ExchangeID: exchangeID,
+		Phase:      phase,
+	}
+}
+
+// UpstreamErrorUpdateMessage tells the client that a request could not be forwarded
+type UpstreamErrorUpdateMessage struct {
+	Type       UpdateType
+	ExchangeID uint64
+	Host       string
+	RequestURI string
+	Error      string
+}
+
+// NewUpstreamErrorUpdateMessage creates a new UpstreamErrorUpdateMessage
+func NewUpstreamErrorUpdateMessage(exchangeID uint64, host string, requestURI string, err error) UpstreamErrorUpdateMessage {
+	return UpstreamErrorUpdateMessage{
+		Type:       UpstreamErrorUpdate,
+		ExchangeID: exchangeID,
+		Host:       host,
+		RequestURI: requestURI,
+		Error:      err.Error(),
+	}
+}
+
+// HistoryUpdateMessage adds exchanges that were not seen by the proxy to the history
+type HistoryUpdateMessage struct {
+	Type    UpdateType
+	Entries []HistoryEntry
+}
+
+// NewHistoryUpdateMessage creates a new HistoryUpdateMessage
+func NewHistoryUpdateMessage(entries []HistoryEntry) HistoryUpdateMessage {
+	return HistoryUpdateMessage{
+		Type:    HistoryUpdate,
+		Entries: entries,
+	}
+}
+
+// HARExportUpdateMessage sends the history as HAR to the client that asked for it
+type HARExportUpdateMessage struct {
+	Type  UpdateType
+	Token string
+	HAR   string
+}
+
+// NewHARExportUpdateMessage creates a new HARExportUpdateMessage
+func NewHARExportUpdateMessage(token string, har []byte) HARExportUpdateMessage {
+	return HARExportUpdateMessage{
+		Type:  HARExportUpdate,
+		Token: token,
+		HAR:   string(har),
+	}
+}
+
+// TimingsUpdateMessage tells the client where the time of a finished exchange went
+type TimingsUpdateMessage struct {
+	Type       UpdateType
+	ExchangeID uint64
+	Timings    proxy.Timings
+}
+
+// NewTimingsUpdateMessage creates a new TimingsUpdateMessage
+func NewTimingsUpdateMessage(exchangeID uint64, timings proxy.Timings) TimingsUpdateMessage {
+	return TimingsUpdateMessage{
+		Type:       TimingsUpdate,
+		ExchangeID: exchangeID,
+		Timings:    timings,
+	}
+}
+
+// BreakpointsUpdateMessage tells the client which breakpoints are set
+type BreakpointsUpdateMessage struct {
+	Type        UpdateType
+	Breakpoints []Breakpoint
+}
+
+// NewBreakpointsUpdateMessage creates a new BreakpointsUpdateMessage
+func NewBreakpointsUpdateMessage(breakpoints []Breakpoint) BreakpointsUpdateMessage {
+	return BreakpointsUpdateMessage{
+		Type:        BreakpointsUpdate,
+		Breakpoints: breakpoints,
+	}
+}
+
+// BreakPhaseUpdateMessage tells the client in which phases the debugger pauses
+type BreakPhaseUpdateMessage struct {
+	Type       UpdateType
+	BreakPhase BreakPhase
+}
+
+// NewBreakPhaseUpdateMessage creates a new BreakPhaseUpdateMessage
+func NewBreakPhaseUpdateMessage(breakPhase BreakPhase) BreakPhaseUpdateMessage {
+	return BreakPhaseUpdateMessage{
+		Type:       BreakPhaseUpdate,
+		BreakPhase: breakPhase,
+	}
+}
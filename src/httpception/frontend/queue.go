@@ -0,0 +1,104 @@
+package frontend
+
+import (
+	"sync"
+	"time"
+
+	"httpception/interceptor"
+)
+
+// heldExchange is an intercepted request or response that waits for a debugger command
+type heldExchange struct {
+	HeldExchange
+	commandChan chan Command
+	since       time.Time
+}
+
+// pauseQueue keeps the requests and responses held by the debugger in the order they arrived.
+// An exchange is held in one phase at a time, so its ID identifies what is held.
+type pauseQueue struct {
+	lock *sync.Mutex
+	held []*heldExchange
+}
+
+// newPauseQueue creates an empty pauseQueue
+func newPauseQueue() *pauseQueue {
+	return &pauseQueue{
+		lock: &sync.Mutex{},
+		held: make([]*heldExchange, 0),
+	}
+}
+
+// hold queues the request or response of an exchange
+func (q *pauseQueue) hold(exchangeID uint64, phase interceptor.Phase, summary string, message string) *heldExchange {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	held := &heldExchange{
+		HeldExchange: HeldExchange{
+			ExchangeID: exchangeID,
+			Phase:      phase,
+			Summary:    summary,
+			Message:    message,
+		},
+
+		// buffered so that delivering a command never blocks the frontend
+		commandChan: make(chan Command, 1),
+		since:       time.Now(),
+	}
+	q.held = append(q.held, held)
+	return held
+}
+
+// release removes a held request or response from the queue
+func (q *pauseQueue) release(held *heldExchange) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, h := range q.held {
+		if h == held {
+			q.held = append(q.held[:i], q.held[i+1:]...)
+			return
+		}
+	}
+}
+
+// deliver hands a command to the held request or response of the exchange it targets.
+// An ID of 0 targets the oldest one. It returns false if nothing with that ID is held.
+func (q *pauseQueue) deliver(command Command) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, h := range q.held {
+		if command.ID == 0 || h.ExchangeID == command.ID {
+
+			// a command that is still pending takes precedence
+			select {
+			case h.commandChan <- command:
+			default:
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// continueAll lets every held request and response continue
+func (q *pauseQueue) continueAll() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, h := range q.held {
+		select {
+		case h.commandChan <- Command{Type: ContinueCommand, ID: h.ExchangeID}:
+		default:
+		}
+	}
+}
+
+// list returns everything that is currently held
+func (q *pauseQueue) list() []HeldExchange {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	list := make([]HeldExchange, 0, len(q.held))
+	for _, h := range q.held {
+		list = append(list, h.HeldExchange)
+	}
+	return list
+}
@@ -0,0 +1,40 @@
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+
+	"httpception/proxy"
+)
+
+// replay sends a request from the history again, edited if the command carries a raw
+// request, and records the result as a new exchange linked to the original one
+func (f *WebSocketFrontend) replay(command Command) {
+	entry, ok := f.history.Entry(command.ID)
+	if !ok {
+		f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("No exchange with ID %d in the history", command.ID))
+		return
+	}
+	raw := entry.Request.Raw()
+	if len(command.Value) > 0 {
+		raw = command.Value
+	}
+	request, err := ParseRequest(raw)
+	if err != nil {
+		f.updateChan <- NewErrorUpdateMessage(fmt.Errorf("Failed to parse replayed request: %s", err))
+		return
+	}
+	id := f.ids.Next()
+	details := NewRequestDetails(request)
+	details.Scheme, details.ClientHost = entry.Request.Scheme, entry.Request.ClientHost
+	message := NewRequestUpdateMessage(id, false, entry.Route, details)
+	message.ReplayOf = entry.ID
+	f.updateChan <- message
+
+	// wait for the proxy to forward it
+	responseChan := make(chan *http.Response, 1)
+	f.replayChan <- proxy.Replay{ExchangeID: id, Route: entry.Route, Request: request, ResponseChan: responseChan}
+	response := <-responseChan
+	defer response.Body.Close()
+	f.updateChan <- NewResponseUpdateMessage(id, false, NewResponseDetails(response))
+}
@@ -20,28 +20,45 @@ type SocketHandler struct {
 	connections       []*WebSocketConn
 	commandChan       chan<- Command
 	updateChan        <-chan UpdateInterface
-	newConnectionChan chan<- struct{}
+	newConnectionChan chan *WebSocketConn
+	history           *History
+	initialUpdate     func() UpdateInterface
 }
 
-// NewSocketHandler creates a websocket connection handler
+// NewSocketHandler creates a websocket connection handler. Every update that is sent
+// is recorded in the history, and new clients first receive the initial update.
 func NewSocketHandler(
 	commandChan chan<- Command,
 	updateChan <-chan UpdateInterface,
-	newConnectionChan chan<- struct{}) *SocketHandler {
+	history *History,
+	initialUpdate func() UpdateInterface) *SocketHandler {
 	return &SocketHandler{
 		connLock:          &sync.Mutex{},
 		connections:       make([]*WebSocketConn, 0, 1),
 		commandChan:       commandChan,
 		updateChan:        updateChan,
-		newConnectionChan: newConnectionChan,
+		newConnectionChan: make(chan *WebSocketConn),
+		history:           history,
+		initialUpdate:     initialUpdate,
 	}
 }
 
-// Run starts the socket handler
+// Run starts the socket handler. Updates and new connections are handled in the same
+// goroutine, so a new client sees every update exactly once.
 func (s *SocketHandler) Run() {
 	for {
-		update := <-s.updateChan
-		if len(s.connections) > 0 {
+		select {
+		case update := <-s.updateChan:
+			switch message := update.(type) {
+			case RequestUpdateMessage:
+				s.history.AddRequest(message)
+			case ResponseUpdateMessage:
+				s.history.AddResponse(message)
+			case TimingsUpdateMessage:
+				s.history.AddTimings(message)
+			case HistoryUpdateMessage:
+				s.history.Add(message.Entries...)
+			}
 			s.connLock.Lock()
 			for i, conn := range s.connections {
 				if conn == nil {
@@ -54,6 +71,15 @@ func (s *SocketHandler) Run() {
 				}
 			}
 			s.connLock.Unlock()
+		case conn := <-s.newConnectionChan:
+			if err := websocket.JSON.Send(conn.Conn, s.initialUpdate()); err != nil {
+				fmt.Printf("\nERROR] %v", err)
+				conn.DoneChan <- true
+				continue
+			}
+			s.connLock.Lock()
+			s.connections = append(s.connections, conn)
+			s.connLock.Unlock()
 		}
 	}
 }
@@ -62,13 +88,10 @@ func (s *SocketHandler) Run() {
 func (s *SocketHandler) HandleConn(ws *websocket.Conn) {
 	defer ws.Close()
 	doneChan := make(chan bool, 1)
-	s.connLock.Lock()
-	s.connections = append(s.connections, &WebSocketConn{
+	s.newConnectionChan <- &WebSocketConn{
 		Conn:     ws,
 		DoneChan: doneChan,
-	})
-	s.connLock.Unlock()
-	s.newConnectionChan <- struct{}{}
+	}
 
 	// read commands
 forloop:
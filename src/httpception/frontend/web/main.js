@@ -2,18 +2,93 @@ var updateTypes = {
     NewRequest: 0,
     NewResponse: 1,
     DebuggingToggle: 2,
-    InitialUpdate: 3
+    InitialUpdate: 3,
+    Error: 4,
+    Resumed: 5,
+    UpstreamError: 6,
+    History: 7,
+    HARExport: 8,
+    Timings: 9,
+    Breakpoints: 10,
+    BreakPhase: 11
+};
+
+var phases = {
+    Request: 0,
+    Response: 1
 };
 
 var commandTypes = {
     EnableDebugging: 0,
     DisableDebugging: 1,
-    ContinueDebugging: 2
+    ContinueDebugging: 2,
+    EditRequest: 3,
+    EditResponse: 4,
+    Respond: 5,
+    Drop: 6,
+    ExportHAR: 7,
+    ImportHAR: 8,
+    Replay: 9,
+    AddBreakpoint: 10,
+    RemoveBreakpoint: 11,
+    SetBreakPhase: 12,
+    StepOver: 13
+};
+
+var exchanges = {};
+var heldExchanges = {};
+var selectedHeld = null;
+var harExportTokens = {};
+var viewedExchange = null;
+
+// decodeBody turns a base64 encoded body into text
+var decodeBody = function(body) {
+    if(!body) {
+        return '';
+    }
+    var binary = atob(body);
+    try {
+        return decodeURIComponent(escape(binary));
+    } catch(e) {
+        return binary;
+    }
 };
 
-var receivedRequests = [];
-var receivedResponses = [];
-var receivedRequestsCount = 0;
+var formatHeader = function(header) {
+    return _.map(_.keys(header || {}).sort(), function(name) {
+        return _.map(header[name], function(value) { return name + ': ' + value + '\r\n'; }).join('');
+    }).join('');
+};
+
+// formatTimings describes where the time of an exchange went, durations are in nanoseconds
+var formatTimings = function(timings) {
+    if(!timings || !timings.Total) {
+        return '';
+    }
+    var ms = function(d) { return (d / 1e6).toFixed(1) + ' ms'; };
+    var parts = [];
+    if(timings.ConnectionReused) {
+        parts.push('reused connection');
+    } else {
+        parts.push('DNS ' + ms(timings.DNS), 'connect ' + ms(timings.Connect), 'TLS ' + ms(timings.TLSHandshake));
+    }
+    parts.push('first byte ' + ms(timings.TimeToFirstByte), 'transfer ' + ms(timings.Transfer), 'paused ' + ms(timings.Paused), 'total ' + ms(timings.Total));
+    return parts.join(', ');
+};
+
+// formatRequest turns request details into raw HTTP for viewing and editing
+var formatRequest = function(request) {
+    return request.Method + ' ' + request.URL + ' ' + request.Proto + '\r\n' +
+        'Host: ' + request.Host + '\r\n' + formatHeader(request.Header) + '\r\n' + decodeBody(request.Body);
+};
+
+// formatResponse turns response details into raw HTTP for viewing and editing
+var formatResponse = function(response) {
+    if(!response) {
+        return '';
+    }
+    return response.Proto + ' ' + response.Status + '\r\n' + formatHeader(response.Header) + '\r\n' + decodeBody(response.Body);
+};
 
 window.onload = function() {
     var toggleDebugging = function(enabled) {
@@ -23,6 +98,10 @@ window.onload = function() {
             $('#request_listing_interface').hide();
             $('#debug_stop').prop('disabled', false);
             $('#debug_continue').prop('disabled', false);
+            $('#debug_step_over').prop('disabled', false);
+            $('#debug_send_edited').prop('disabled', false);
+            $('#debug_drop').prop('disabled', false);
+            $('#debug_respond').prop('disabled', false);
             $('#debug_start').prop('disabled', true);
         } else {
             console.log('debugger has stopped');
@@ -30,38 +109,209 @@ window.onload = function() {
             $('#request_listing_interface').show();
             $('#debug_stop').prop('disabled', true);
             $('#debug_continue').prop('disabled', true);
+            $('#debug_step_over').prop('disabled', true);
+            $('#debug_send_edited').prop('disabled', true);
+            $('#debug_drop').prop('disabled', true);
+            $('#debug_respond').prop('disabled', true);
             $('#debug_start').prop('disabled', false);
         }
     };
 
+    var selectHeld = function(id) {
+        selectedHeld = id;
+        $('.held-listing').removeClass('active');
+        if(id === null) {
+            $('#request').val('');
+            $('#response').val('');
+            return;
+        }
+        var held = heldExchanges[id];
+        $('.held-listing[data-id="' + id + '"]').addClass('active');
+        if(held.Phase === phases.Request) {
+            $('#request').val(held.Message);
+            $('#response').val('');
+        } else {
+            $('#response').val(held.Message);
+        }
+    };
+
+    var addHeld = function(held) {
+        heldExchanges[held.ExchangeID] = held;
+        var label = (held.Phase === phases.Request ? 'Request' : 'Response') + ' #' + held.ExchangeID + ': ' + held.Summary;
+        $('#held_listing').append($('<button type="button" class="held-listing list-group-item"></button>').attr('data-id', held.ExchangeID).text(label));
+        if(selectedHeld === null) {
+            selectHeld(held.ExchangeID);
+        }
+    };
+
+    var removeHeld = function(id) {
+        delete heldExchanges[id];
+        $('.held-listing[data-id="' + id + '"]').remove();
+        if(selectedHeld === id) {
+            var next = $('.held-listing').first();
+            selectHeld(next.length > 0 ? next.data('id') : null);
+        }
+    };
+
+    var addExchange = function(entry) {
+        exchanges[entry.ID] = entry;
+        $('#request_listing').append(exchangeListing(entry));
+    };
+
+    // an exchange is sent again when its request was edited
+    var updateExchange = function(id, route, request) {
+        var entry = exchanges[id];
+        entry.Route = route;
+        entry.Request = request;
+        $('.request-listing[data-id="' + id + '"]').replaceWith(exchangeListing(entry));
+    };
+
+    var exchangeListing = function(entry) {
+        var item = $('<button type="button" class="request-listing list-group-item"></button>')
+            .attr('data-id', entry.ID)
+            .append($('<span class="label label-default"></span>').text(entry.Route))
+            .append(document.createTextNode(' ' + entry.Request.Method + ' ' + entry.Request.Host + entry.Request.URL));
+        if(entry.ReplayOf) {
+            item.append(' ').append($('<span class="label label-info"></span>').text('replay of #' + entry.ReplayOf));
+        }
+        return item;
+    };
+
+    var showBreakpoints = function(breakpoints) {
+        $('#breakpoint_listing').empty();
+        _.each(breakpoints, function(breakpoint) {
+            var conditions = _.compact([
+                breakpoint.Method,
+                breakpoint.Host,
+                breakpoint.Path,
+                breakpoint.PathRegexp && '/' + breakpoint.PathRegexp + '/',
+                breakpoint.Header && breakpoint.Header + (breakpoint.HeaderValue ? ': ' + breakpoint.HeaderValue : ''),
+                breakpoint.BodyContains && 'body contains "' + breakpoint.BodyContains + '"',
+                breakpoint.Status && 'status ' + breakpoint.Status,
+                breakpoint.BreakPhase !== 'both' && 'on ' + breakpoint.BreakPhase
+            ]);
+            $('#breakpoint_listing').append($('<span class="label label-primary"></span>')
+                .text(conditions.join(' ') || 'everything')
+                .append(' ')
+                .append($('<a href="#" class="remove-breakpoint">&times;</a>').attr('data-id', breakpoint.ID)))
+                .append(' ');
+        });
+    };
+
+    var sendCommand = function(type, value) {
+        $('#debug_error').hide();
+        socket.send(JSON.stringify({ type: type, id: selectedHeld || 0, value: value }));
+    };
+
     // listen on websocket
     var socket = new WebSocket("ws://" + window.location.host + "/_socket");
     socket.onmessage = function(msg) {
         var receivedData = JSON.parse(msg.data);
         switch(receivedData.Type) {
         case updateTypes.NewRequest:
-            receivedRequests.push(receivedData);
-            $('#request').text(receivedData.Request);
-            $('#response').text('');
-            $('#request_listing').append('<button data-number="' + receivedRequestsCount + '" ""type="button" class="request-listing list-group-item">' + receivedData.Host + receivedData.RequestURI + '</button>');
-            receivedRequestsCount++;
+            if(receivedData.Paused) {
+                addHeld({ ExchangeID: receivedData.ExchangeID, Phase: phases.Request, Summary: '[' + receivedData.Route + '] ' + receivedData.Request.Host + receivedData.Request.URL, Message: formatRequest(receivedData.Request) });
+            }
+            if(exchanges[receivedData.ExchangeID]) {
+                updateExchange(receivedData.ExchangeID, receivedData.Route, receivedData.Request);
+            } else {
+                addExchange({ ID: receivedData.ExchangeID, Route: receivedData.Route, ReplayOf: receivedData.ReplayOf, Request: receivedData.Request, Response: null, Time: receivedData.Time });
+            }
             break;
         case updateTypes.NewResponse:
-            receivedResponses.push(receivedData);
-            $('#response').text(receivedData.Response);
+            if(exchanges[receivedData.ExchangeID]) {
+                exchanges[receivedData.ExchangeID].Response = receivedData.Response;
+            }
+            if(receivedData.Paused) {
+                addHeld({ ExchangeID: receivedData.ExchangeID, Phase: phases.Response, Summary: receivedData.Response.Status, Message: formatResponse(receivedData.Response) });
+            }
+            break;
+        case updateTypes.Resumed:
+            if(heldExchanges[receivedData.ExchangeID] && heldExchanges[receivedData.ExchangeID].Phase === receivedData.Phase) {
+                removeHeld(receivedData.ExchangeID);
+            }
+            break;
+        case updateTypes.Error:
+            console.log('error: ' + receivedData.Error);
+            $('#debug_error').text(receivedData.Error).show();
+            break;
+        case updateTypes.UpstreamError:
+            console.log('upstream error: ' + receivedData.Error);
+            $('#upstream_errors').append($('<div class="alert alert-warning"></div>').text(receivedData.Host + receivedData.RequestURI + ': ' + receivedData.Error));
+            break;
+        case updateTypes.Timings:
+            if(exchanges[receivedData.ExchangeID]) {
+                exchanges[receivedData.ExchangeID].Timings = receivedData.Timings;
+            }
+            break;
+        case updateTypes.Breakpoints:
+            showBreakpoints(receivedData.Breakpoints);
+            break;
+        case updateTypes.BreakPhase:
+            $('#break_phase').val(receivedData.BreakPhase);
+            break;
+        case updateTypes.History:
+            _.each(receivedData.Entries, addExchange);
+            break;
+        case updateTypes.HARExport:
+            // every client is told about an export, only the one that asked downloads it
+            if(harExportTokens[receivedData.Token]) {
+                delete harExportTokens[receivedData.Token];
+                var link = document.createElement('a');
+                link.href = URL.createObjectURL(new Blob([receivedData.HAR], { type: 'application/json' }));
+                link.download = 'httpception.har';
+                link.click();
+                URL.revokeObjectURL(link.href);
+            }
             break;
         case updateTypes.DebuggingToggle:
             toggleDebugging(receivedData.DebuggingEnabled);
             break;
         case updateTypes.InitialUpdate:
             toggleDebugging(receivedData.DebuggingEnabled);
+            showBreakpoints(receivedData.Breakpoints);
+            $('#break_phase').val(receivedData.BreakPhase);
+            _.each(receivedData.History, addExchange);
+            _.each(receivedData.Held, addHeld);
+            break;
         default:
             console.log('Unknown update type: ' + receivedData.Type);
         }
     };
 
     $('#debug_continue').on('click', function() {
-        socket.send(JSON.stringify({ type: commandTypes.ContinueDebugging, value: '' }));
+        sendCommand(commandTypes.ContinueDebugging, '');
+    });
+
+    $('#debug_step_over').on('click', function() {
+        sendCommand(commandTypes.StepOver, '');
+    });
+
+    $('#break_phase').on('change', function() {
+        sendCommand(commandTypes.SetBreakPhase, $(this).val());
+    });
+
+    $('#debug_send_edited').on('click', function() {
+        if(selectedHeld === null) {
+            return;
+        }
+        if(heldExchanges[selectedHeld].Phase === phases.Request) {
+            sendCommand(commandTypes.EditRequest, $('#request').val());
+        } else {
+            sendCommand(commandTypes.EditResponse, $('#response').val());
+        }
+    });
+
+    $('#debug_respond').on('click', function() {
+        if(selectedHeld !== null && heldExchanges[selectedHeld].Phase === phases.Request) {
+            sendCommand(commandTypes.Respond, $('#response').val());
+        }
+    });
+
+    $('#debug_drop').on('click', function() {
+        if(selectedHeld !== null && heldExchanges[selectedHeld].Phase === phases.Request) {
+            sendCommand(commandTypes.Drop, '');
+        }
     });
 
     $('#debug_start').on('click', function() {
@@ -74,10 +324,71 @@ window.onload = function() {
         socket.send(JSON.stringify({ type: commandTypes.DisableDebugging, value: '' }));
     });
 
+    $('#breakpoint_form').on('submit', function(e) {
+        e.preventDefault();
+        sendCommand(commandTypes.AddBreakpoint, JSON.stringify({
+            Method: $('#breakpoint_method').val(),
+            Host: $('#breakpoint_host').val(),
+            Path: $('#breakpoint_path').val(),
+            PathRegexp: $('#breakpoint_path_regexp').val(),
+            Header: $('#breakpoint_header').val(),
+            HeaderValue: $('#breakpoint_header_value').val(),
+            BodyContains: $('#breakpoint_body').val(),
+            Status: parseInt($('#breakpoint_status').val(), 10) || 0,
+            BreakPhase: $('#breakpoint_break_phase').val()
+        }));
+        this.reset();
+    });
+
+    $('body').on('click', '.remove-breakpoint', function(e) {
+        e.preventDefault();
+        socket.send(JSON.stringify({ type: commandTypes.RemoveBreakpoint, id: $(this).data('id'), value: '' }));
+    });
+
+    $('#har_export').on('click', function() {
+        var token = Math.random().toString(36).slice(2);
+        harExportTokens[token] = true;
+        sendCommand(commandTypes.ExportHAR, token);
+    });
+
+    $('#har_import').on('click', function() {
+        $('#har_file').click();
+    });
+
+    $('#har_file').on('change', function() {
+        var file = this.files[0];
+        if(!file) {
+            return;
+        }
+        var reader = new FileReader();
+        reader.onload = function() {
+            sendCommand(commandTypes.ImportHAR, reader.result);
+        };
+        reader.readAsText(file);
+        $(this).val('');
+    });
+
+    $('#replay').on('click', function() {
+        if(viewedExchange === null) {
+            return;
+        }
+
+        // send the request as shown, which may have been edited
+        var request = $('#view_request').val();
+        socket.send(JSON.stringify({ type: commandTypes.Replay, id: viewedExchange, value: request === formatRequest(exchanges[viewedExchange].Request).replace(/\r\n/g, '\n') ? '' : request }));
+        $('#view_request_modal').modal('hide');
+    });
+
+    $('body').on('click', '.held-listing', function() {
+        selectHeld($(this).data('id'));
+    });
+
     $('body').on('click', '.request-listing', function() {
-        var requestNumber = $(this).data('number');
-        $('#view_request').text(receivedRequests[requestNumber].Request);
-        $('#view_response').text(receivedResponses[requestNumber].Response);
+        viewedExchange = $(this).data('id');
+        var exchange = exchanges[viewedExchange];
+        $('#view_request').val(formatRequest(exchange.Request));
+        $('#view_response').val(formatResponse(exchange.Response));
+        $('#view_timings').text(formatTimings(exchange.Timings));
         $('#view_request_modal').modal();
     });
 }
@@ -1,22 +1,85 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"httpception/certs"
 	"httpception/frontend"
+	"httpception/interceptor"
+	"httpception/proxy"
 )
 
 var listenAddress string
 var sendAddress string
 var debuggingAddress string
+var maxConnections int
+var idleClientTimeout time.Duration
+var historySize int
+var historyFile string
+var harIn string
+var harOut string
+var maxIdleConnections int
+var idleTimeout time.Duration
+var upstreamTimeout time.Duration
+var listenTLS bool
+var listenCertFile string
+var listenKeyFile string
+var caDirectory string
+var routes routeList
+var routesFile string
+var rewritesFile string
+var scriptFile string
+var logExchanges bool
+var stubsFile string
+var offline bool
+var forwardProxy bool
+var interceptTunnels bool
+var sendTLS bool
+var sendTLSOptions proxy.UpstreamTLSOptions
 
 func init() {
 	flag.StringVar(&listenAddress, "listen", "", "Address to listen for new connections (ex: localhost:3333)")
-	flag.StringVar(&sendAddress, "send", "", "Address to listen for new connections (ex: localhost:4444)")
+	flag.StringVar(&sendAddress, "send", "", "Address to forward traffic to, prefix with https:// to use TLS (ex: localhost:4444)")
+	flag.Var(&routes, "route", "Route requests for a host and/or path prefix to another upstream, can be repeated (ex: api.local/v1=localhost:5555)")
+	flag.StringVar(&routesFile, "routes", "", "JSON file with a list of routes, each with name, host, path and upstream")
+	flag.StringVar(&rewritesFile, "rewrites", "", "JSON file with a list of rewrite rules, reloaded when it changes")
+	flag.StringVar(&stubsFile, "stubs", "", "JSON file with a list of canned responses that answer the requests they match, reloaded when it changes")
+	flag.BoolVar(&offline, "offline", false, "Answer requests that no stub matches with 404 instead of forwarding them")
+	flag.BoolVar(&logExchanges, "log", false, "Print a line for every request and response")
+	flag.StringVar(&scriptFile, "script", "", "Starlark file defining onRequest(req) and/or onResponse(req, resp), reloaded when it changes")
+	flag.BoolVar(&sendTLS, "send-tls", false, "Use TLS to connect to the send address")
+	flag.StringVar(&sendTLSOptions.ServerName, "send-sni", "", "Server name to verify and send as SNI to the send address (default: its host)")
+	flag.StringVar(&sendTLSOptions.CAFile, "send-ca", "", "PEM bundle of CA certificates to trust for the send address (default: system roots)")
+	flag.StringVar(&sendTLSOptions.CertFile, "send-cert", "", "PEM client certificate to present to the send address")
+	flag.StringVar(&sendTLSOptions.KeyFile, "send-key", "", "PEM private key of the client certificate")
+	flag.BoolVar(&sendTLSOptions.InsecureSkipVerify, "send-insecure", false, "Do not verify the certificate of the send address")
+	flag.BoolVar(&forwardProxy, "forward", false, "Act as a forward proxy (for HTTP_PROXY) that sends requests to their own host instead of -send")
+	flag.BoolVar(&interceptTunnels, "mitm", false, "Intercept HTTPS tunneled through CONNECT in forward mode, using certificates minted by the CA in -ca-dir")
+	flag.BoolVar(&listenTLS, "listen-tls", false, "Accept TLS connections, using -tls-cert/-tls-key or certificates minted by the CA in -ca-dir")
+	flag.StringVar(&listenCertFile, "tls-cert", "", "PEM certificate presented to clients when -listen-tls is set")
+	flag.StringVar(&listenKeyFile, "tls-key", "", "PEM private key of the certificate presented to clients")
+	flag.StringVar(&caDirectory, "ca-dir", "", "Directory of the CA that mints certificates per host, created on first run (default: <user config dir>/httpception)")
 	flag.StringVar(&debuggingAddress, "debug", ":9999", "Address to listen for debugging connection (default: :9999)")
+	flag.IntVar(&historySize, "history-size", 1000, "Number of exchanges kept in the history")
+	flag.StringVar(&historyFile, "history-file", "", "File to keep the history in across restarts")
+	flag.StringVar(&harIn, "har-in", "", "HAR file to load into the history on startup")
+	flag.StringVar(&harOut, "har-out", "", "HAR file to save the history to on exit")
+	flag.IntVar(&maxConnections, "max-conns", 64, "Maximum number of client connections served at once, 0 for no limit")
+	flag.DurationVar(&idleClientTimeout, "idle-client-timeout", time.Minute, "How long an idle client connection is kept open, so it does not hold one of -max-conns, 0 for no limit")
+	flag.IntVar(&maxIdleConnections, "max-idle-conns", 16, "Maximum number of idle connections kept open to the send address")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 90*time.Second, "How long an idle connection to the send address is kept open")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", 0, "How long to wait for the send address to respond before answering 504, 0 for no limit")
 }
 
 func main() {
@@ -24,9 +87,77 @@ func main() {
 	if len(listenAddress) == 0 {
 		showHelpAndExit("listen is a required parameter")
 	}
-	if len(sendAddress) == 0 {
+	if offline && len(stubsFile) == 0 {
+		showHelpAndExit("offline requires stubs")
+	}
+
+	// nothing is forwarded offline, so the catch-all route only has to exist
+	if offline && len(sendAddress) == 0 && len(routes) == 0 && len(routesFile) == 0 && !forwardProxy {
+		sendAddress = "localhost"
+	}
+	if len(sendAddress) == 0 && len(routes) == 0 && len(routesFile) == 0 && !forwardProxy {
 		showHelpAndExit("send is a required parameter")
 	}
+	if interceptTunnels && !forwardProxy {
+		showHelpAndExit("mitm requires forward")
+	}
+
+	// build the routing table, with the send address as the catch-all route
+	if len(routesFile) > 0 {
+		loaded, err := proxy.LoadRoutes(routesFile)
+		if err != nil {
+			fmt.Printf("Error loading routes: %s\n", err)
+			os.Exit(1)
+		}
+		routes = append(routes, loaded...)
+	}
+	var sendRoute proxy.Route
+	if len(sendAddress) > 0 {
+		if sendTLS && !strings.Contains(sendAddress, "://") {
+			sendAddress = "https://" + sendAddress
+		}
+		var err error
+		if sendRoute, err = proxy.NewRoute("", "", "", sendAddress); err != nil {
+			showHelpAndExit(err.Error())
+		}
+	}
+	var rewriter *proxy.Rewriter
+	if len(rewritesFile) > 0 {
+		var err error
+		if rewriter, err = proxy.NewRewriter(rewritesFile); err != nil {
+			fmt.Printf("Error loading rewrite rules: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var script *proxy.Script
+	if len(scriptFile) > 0 {
+		var err error
+		if script, err = proxy.NewScript(scriptFile); err != nil {
+			fmt.Printf("Error loading script: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var stubs *proxy.Stubs
+	if len(stubsFile) > 0 {
+		var err error
+		if stubs, err = proxy.NewStubs(stubsFile); err != nil {
+			fmt.Printf("Error loading stubs: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var certificateAuthority *certs.CertificateAuthority
+	if interceptTunnels {
+		var err error
+		if certificateAuthority, err = loadCertificateAuthority(); err != nil {
+			fmt.Printf("Error loading CA: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	sendTLSConfig, err := proxy.NewUpstreamTLSConfig(sendTLSOptions)
+	if err != nil {
+		fmt.Printf("Error configuring TLS: %s\n", err)
+		os.Exit(1)
+	}
 
 	// start listening for connections
 	l, err := net.Listen("tcp", listenAddress)
@@ -34,40 +165,205 @@ func main() {
 		fmt.Printf("Error listening on %s: %s", listenAddress, err)
 		os.Exit(1)
 	}
-
-	// accept connections indefinitely
-	connectionChannel := make(chan net.Conn)
-	errorChan := make(chan error)
-	quit := make(chan struct{})
-	go func() {
-		for {
-
-			//TODO: handle accept errors
-			conn, _ := l.Accept()
-			connectionChannel <- conn
+	if listenTLS {
+		config, err := newListenTLSConfig()
+		if err != nil {
+			fmt.Printf("Error configuring TLS: %s\n", err)
+			os.Exit(1)
 		}
-	}()
+		l = tls.NewListener(l, config)
+	}
 
+	errorChan := make(chan error)
+	watching, stopWatching := context.WithCancel(context.Background())
+	if rewriter != nil {
+		go rewriter.Watch(watching, time.Second, reportReload("rewrite rules", rewritesFile, errorChan))
+	}
+	if script != nil {
+		go script.Watch(watching, time.Second, reportReload("script", scriptFile, errorChan))
+	}
+	if stubs != nil {
+		go stubs.Watch(watching, time.Second, reportReload("stubs", stubsFile, errorChan))
+	}
 	// handle errors
 	go func() {
 		for {
 			select {
 			case err := <-errorChan:
-				fmt.Errorf("ERROR: %s", err)
+				fmt.Printf("ERROR: %s\n", err)
 			}
 		}
 	}()
 
 	// initialize frontend
+	history, err := frontend.NewHistory(historySize, historyFile)
+	if err != nil {
+		fmt.Printf("Error loading history: %s\n", err)
+		os.Exit(1)
+	}
+	if len(harIn) > 0 {
+		if err := importHAR(history, harIn); err != nil {
+			fmt.Printf("Error loading HAR: %s\n", err)
+			os.Exit(1)
+		}
+	}
 	updateChan := make(chan frontend.UpdateInterface)
 	commandChan := make(chan frontend.Command)
-	frontend := frontend.Frontend(frontend.NewWebSocketFrontend(updateChan, commandChan, debuggingAddress))
+	replayChan := make(chan proxy.Replay)
+	ids := proxy.NewIDSequence(history.LastID())
+	frontend := frontend.Frontend(frontend.NewWebSocketFrontend(updateChan, commandChan, replayChan, debuggingAddress, history, ids))
 	go frontend.Start()
 
+	// exchanges go through the rewrite rules and script before the debugger
+	interceptors := interceptor.NewChain()
+	if logExchanges {
+		interceptors.Add(interceptor.NewLogger(os.Stdout))
+	}
+	if rewriter != nil {
+		interceptors.Add(rewriter.Before())
+	}
+	if script != nil {
+		interceptors.Add(script)
+	}
+	interceptors.Add(frontend)
+	if rewriter != nil {
+		interceptors.Add(rewriter.After())
+	}
+	interceptors.Add(frontend.Final())
+
+	// stubs answer in place of the upstreams, which are left alone offline
+	newTransport := func(tlsConfig *tls.Config) http.RoundTripper {
+		var transport http.RoundTripper = proxy.NewUpstreamTransport(maxIdleConnections, idleTimeout, upstreamTimeout, tlsConfig)
+		if stubs != nil {
+			if offline {
+				transport = nil
+			}
+			transport = proxy.NewStubTransport(stubs, transport)
+		}
+		return transport
+	}
+
+	// only the send address is dialed with the send TLS options, the other upstreams
+	// are verified against the system roots
+	transport := newTransport(nil)
+	if len(sendAddress) > 0 {
+		sendRoute.Transport = newTransport(sendTLSConfig)
+		routes = append(routes, sendRoute)
+	}
+
 	// handle incoming connections
-	handler := NewHTTPProxy(connectionChannel, errorChan, frontend.InterceptRequest, frontend.InterceptResponse, sendAddress)
+	handler := proxy.NewHTTPProxy(l, proxy.Options{
+		Routes:               routes,
+		Interceptors:         interceptors,
+		IDs:                  ids,
+		Replays:              replayChan,
+		ReportError:          func(err error) { errorChan <- err },
+		ReportUpstreamError:  frontend.ReportUpstreamError,
+		ReportTimings:        frontend.ReportTimings,
+		MaxConnections:       maxConnections,
+		IdleClientTimeout:    idleClientTimeout,
+		Transport:            transport,
+		ForwardProxy:         forwardProxy,
+		CertificateAuthority: certificateAuthority,
+	})
 	go handler.Start()
-	<-quit
+
+	// run until interrupted
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	stopWatching()
+
+	// let the requests in flight be answered, unless they are held in the debugger for long
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	handler.Shutdown(ctx)
+	cancel()
+	history.Close()
+	if len(harOut) > 0 {
+		if err := exportHAR(history, harOut); err != nil {
+			fmt.Printf("Error saving HAR: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved history to: %s\n", harOut)
+	}
+}
+
+// reportReload reports the reloads of a watched file, or why it failed to load
+func reportReload(name string, path string, errorChan chan<- error) func(error) {
+	return func(err error) {
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		fmt.Printf("Reloaded %s from: %s\n", name, path)
+	}
+}
+
+// importHAR adds the exchanges of a HAR file to the history
+func importHAR(history *frontend.History, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lastID := history.LastID()
+	entries, err := frontend.ImportHAR(b, func() uint64 {
+		lastID++
+		return lastID
+	})
+	if err != nil {
+		return err
+	}
+	history.Add(entries...)
+	return nil
+}
+
+// exportHAR saves the history as a HAR file
+func exportHAR(history *frontend.History, path string) error {
+	b, err := frontend.ExportHAR(history.Entries())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// newListenTLSConfig creates the TLS configuration for client connections, either from the
+// provided certificate or from the local CA
+func newListenTLSConfig() (*tls.Config, error) {
+	if len(listenCertFile) > 0 || len(listenKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(listenCertFile, listenKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load certificate: %s", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	ca, err := loadCertificateAuthority()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: ca.GetCertificate}, nil
+}
+
+// loadCertificateAuthority loads the local CA, creating it on first run
+func loadCertificateAuthority() (*certs.CertificateAuthority, error) {
+	if len(caDirectory) == 0 {
+		configDirectory, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		caDirectory = filepath.Join(configDirectory, "httpception")
+	}
+
+	// clients that do not send SNI get a certificate for the listen host
+	defaultHost, _, err := net.SplitHostPort(listenAddress)
+	if err != nil || len(defaultHost) == 0 {
+		defaultHost = "localhost"
+	}
+	ca, err := certs.LoadOrCreateCertificateAuthority(caDirectory, defaultHost)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Clients must trust the CA certificate in: %s\n", certs.CertificatePath(caDirectory))
+	return ca, nil
 }
 
 func showHelpAndExit(message string) {
@@ -75,3 +371,23 @@ func showHelpAndExit(message string) {
 	flag.Usage()
 	os.Exit(1)
 }
+
+// routeList collects the routes given on the command line
+type routeList []proxy.Route
+
+func (l *routeList) String() string {
+	names := make([]string, 0, len(*l))
+	for _, route := range *l {
+		names = append(names, route.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (l *routeList) Set(spec string) error {
+	route, err := proxy.ParseRoute(spec)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, route)
+	return nil
+}
@@ -0,0 +1,53 @@
+package interceptor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ReadBody reads a body and replaces it with a copy of what was read, so it can still be
+// sent on. The body of a request can be read again by response interceptors after it was sent.
+func ReadBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	if buffered, ok := (*body).(*bufferedBody); ok {
+		return buffered.data
+	}
+	b, _ := io.ReadAll(*body)
+	(*body).Close()
+	*body = newBufferedBody(b)
+	return b
+}
+
+// SetRequestBody replaces the body of a request along with the length that describes it
+func SetRequestBody(request *http.Request, body []byte) {
+	request.Body = newBufferedBody(body)
+	request.ContentLength = int64(len(body))
+	request.TransferEncoding = nil
+	request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// SetResponseBody replaces the body of a response along with the length that describes it
+func SetResponseBody(response *http.Response, body []byte) {
+	response.Body = newBufferedBody(body)
+	response.ContentLength = int64(len(body))
+	response.TransferEncoding = nil
+	response.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// bufferedBody is a body held in memory that remembers its content once it was read
+type bufferedBody struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newBufferedBody(data []byte) *bufferedBody {
+	return &bufferedBody{Reader: bytes.NewReader(data), data: data}
+}
+
+func (b *bufferedBody) Close() error {
+	return nil
+}
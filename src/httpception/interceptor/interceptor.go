@@ -0,0 +1,165 @@
+// Package interceptor lets requests and responses be viewed and changed on their way
+// through the proxy by a chain of interceptors.
+package interceptor
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Exchange is a request and its response on their way through the interceptors
+type Exchange struct {
+
+	// assigned by the proxy, it ties a response to its request
+	ID    uint64
+	Route string
+
+	// the scheme and Host the client asked for, the request is addressed to its route
+	ClientScheme string
+	ClientHost   string
+	Request      *http.Request
+
+	// nil until the response arrives, unless an interceptor answers the request itself
+	Response *http.Response
+
+	dropped bool
+}
+
+// Drop closes the client connection without answering, later interceptors are skipped
+func (e *Exchange) Drop() {
+	e.dropped = true
+}
+
+// Dropped reports whether an interceptor dropped the exchange
+func (e *Exchange) Dropped() bool {
+	return e.dropped
+}
+
+// CompleteResponse fills in what an interceptor may leave out of a response it sets: the
+// body and header, the protocol version and the request it answers
+func (e *Exchange) CompleteResponse() {
+	response := e.Response
+	if response == nil {
+		return
+	}
+	if response.Body == nil {
+		response.Body = http.NoBody
+	}
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+	if response.ProtoMajor == 0 {
+		response.Proto, response.ProtoMajor, response.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if response.Request == nil {
+		response.Request = e.Request
+	}
+}
+
+// Phase is the part of an exchange that is intercepted
+type Phase uint
+
+const (
+
+	// RequestPhase intercepts the request before it is forwarded
+	RequestPhase Phase = iota
+
+	// ResponsePhase intercepts the response before it is returned
+	ResponsePhase = iota
+)
+
+// Interceptor views and changes exchanges. An interceptor that fails should leave the
+// exchange as it was, it is reported and the exchange moves on.
+type Interceptor interface {
+
+	// InterceptRequest is called before the request is forwarded. Setting the Response
+	// answers the request without forwarding it.
+	InterceptRequest(*Exchange) error
+
+	// InterceptResponse is called once the response arrived. The request is the one that
+	// was sent, the response may have been replaced by an interceptor.
+	InterceptResponse(*Exchange) error
+}
+
+// Funcs is an Interceptor made of functions, either of which may be nil
+type Funcs struct {
+	Request  func(*Exchange) error
+	Response func(*Exchange) error
+}
+
+// InterceptRequest calls the Request function
+func (f Funcs) InterceptRequest(exchange *Exchange) error {
+	if f.Request == nil {
+		return nil
+	}
+	return f.Request(exchange)
+}
+
+// InterceptResponse calls the Response function
+func (f Funcs) InterceptResponse(exchange *Exchange) error {
+	if f.Response == nil {
+		return nil
+	}
+	return f.Response(exchange)
+}
+
+// Chain passes exchanges through interceptors in the order they were added, in both
+// phases. A chain is an Interceptor itself, so chains can be nested.
+type Chain struct {
+	lock         *sync.RWMutex
+	interceptors []Interceptor
+}
+
+// NewChain creates a chain of interceptors
+func NewChain(interceptors ...Interceptor) *Chain {
+	return &Chain{
+		lock:         &sync.RWMutex{},
+		interceptors: interceptors,
+	}
+}
+
+// Add appends an interceptor to the chain, exchanges already on their way skip it
+func (c *Chain) Add(interceptor Interceptor) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.interceptors = append(c.interceptors, interceptor)
+}
+
+func (c *Chain) list() []Interceptor {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return append([]Interceptor{}, c.interceptors...)
+}
+
+// InterceptRequest passes the request through the chain until one of the interceptors
+// drops or answers it, returning the errors of those that failed
+func (c *Chain) InterceptRequest(exchange *Exchange) error {
+	var errs []error
+	for _, interceptor := range c.list() {
+		if err := interceptor.InterceptRequest(exchange); err != nil {
+			errs = append(errs, err)
+		}
+		exchange.CompleteResponse()
+		if exchange.Dropped() || exchange.Response != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// InterceptResponse passes the response through the chain until one of the interceptors
+// drops it, returning the errors of those that failed
+func (c *Chain) InterceptResponse(exchange *Exchange) error {
+	var errs []error
+	for _, interceptor := range c.list() {
+		if err := interceptor.InterceptResponse(exchange); err != nil {
+			errs = append(errs, err)
+		}
+		exchange.CompleteResponse()
+		if exchange.Dropped() {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
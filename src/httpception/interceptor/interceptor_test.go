@@ -0,0 +1,111 @@
+package interceptor
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// step is an interceptor that records its name and then does what its action says
+func step(name string, action string, trace *[]string) Interceptor {
+	intercept := func(exchange *Exchange) error {
+		*trace = append(*trace, name)
+		switch action {
+		case "drop":
+			exchange.Drop()
+		case "answer":
+			exchange.Response = &http.Response{StatusCode: http.StatusNoContent}
+		case "fail":
+			return errors.New(name + " failed")
+		}
+		return nil
+	}
+	return Funcs{Request: intercept, Response: intercept}
+}
+
+func TestChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		phase    Phase
+		actions  []string
+		trace    []string
+		errors   []string
+		dropped  bool
+		answered bool
+	}{
+		{name: "request passes", phase: RequestPhase, actions: []string{"", ""}, trace: []string{"a", "b"}},
+		{name: "request dropped", phase: RequestPhase, actions: []string{"drop", ""}, trace: []string{"a"}, dropped: true},
+		{name: "request answered", phase: RequestPhase, actions: []string{"", "answer", ""}, trace: []string{"a", "b"}, answered: true},
+		{name: "request errors", phase: RequestPhase, actions: []string{"fail", "", "fail"}, trace: []string{"a", "b", "c"}, errors: []string{"a failed", "c failed"}},
+		{name: "error before drop", phase: RequestPhase, actions: []string{"fail", "drop", "fail"}, trace: []string{"a", "b"}, errors: []string{"a failed"}, dropped: true},
+		{name: "response passes", phase: ResponsePhase, actions: []string{"", ""}, trace: []string{"a", "b"}},
+		{name: "response dropped", phase: ResponsePhase, actions: []string{"", "drop", ""}, trace: []string{"a", "b"}, dropped: true},
+		{name: "response replaced", phase: ResponsePhase, actions: []string{"answer", ""}, trace: []string{"a", "b"}, answered: true},
+		{name: "response errors", phase: ResponsePhase, actions: []string{"fail", "fail"}, trace: []string{"a", "b"}, errors: []string{"a failed", "b failed"}},
+	}
+	for _, test := range tests {
+		var trace []string
+		chain := NewChain()
+		for i, action := range test.actions {
+			chain.Add(step(string(rune('a'+i)), action, &trace))
+		}
+		exchange := &Exchange{ID: 1, Request: httptest.NewRequest("GET", "/", nil)}
+		var err error
+		if test.phase == RequestPhase {
+			err = chain.InterceptRequest(exchange)
+		} else {
+			exchange.Response = &http.Response{StatusCode: http.StatusOK}
+			err = chain.InterceptResponse(exchange)
+		}
+
+		if !reflect.DeepEqual(trace, test.trace) {
+			t.Errorf("%s: ran %v, want %v", test.name, trace, test.trace)
+		}
+		var errs []string
+		if err != nil {
+			errs = strings.Split(err.Error(), "\n")
+		}
+		if !reflect.DeepEqual(errs, test.errors) {
+			t.Errorf("%s: errors %q, want %q", test.name, errs, test.errors)
+		}
+		if exchange.Dropped() != test.dropped {
+			t.Errorf("%s: dropped = %t, want %t", test.name, exchange.Dropped(), test.dropped)
+		}
+		answered := exchange.Response != nil && exchange.Response.StatusCode == http.StatusNoContent
+		if answered != test.answered {
+			t.Errorf("%s: answered = %t, want %t", test.name, answered, test.answered)
+		}
+	}
+}
+
+func TestChainCompletesResponses(t *testing.T) {
+	var trace []string
+	var log bytes.Buffer
+	chain := NewChain(step("answer", "answer", &trace), NewLogger(&log))
+	request := httptest.NewRequest("GET", "http://example.com/a", nil)
+
+	for _, phase := range []Phase{RequestPhase, ResponsePhase} {
+		exchange := &Exchange{ID: 1, Route: "default", Request: request}
+		var err error
+		if phase == RequestPhase {
+			err = chain.InterceptRequest(exchange)
+		} else {
+			exchange.Response = &http.Response{StatusCode: http.StatusOK}
+			err = chain.InterceptResponse(exchange)
+		}
+		if err != nil {
+			t.Errorf("phase %d failed: %s", phase, err)
+		}
+		response := exchange.Response
+		if response.Body != http.NoBody || response.Header == nil || response.ProtoMajor != 1 || response.ProtoMinor != 1 || response.Request != request {
+			t.Errorf("phase %d left the response incomplete: %+v", phase, response)
+		}
+	}
+	if want := "#1 [default] GET example.com/a -> \n"; log.String() != want {
+		t.Errorf("logged %q, want the replaced response %q", log.String(), want)
+	}
+}
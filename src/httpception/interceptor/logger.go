@@ -0,0 +1,43 @@
+package interceptor
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Logger writes a line for every request and response that reaches it
+type Logger struct {
+	lock   *sync.Mutex
+	writer io.Writer
+}
+
+// NewLogger creates a Logger that writes to a writer
+func NewLogger(writer io.Writer) *Logger {
+	return &Logger{
+		lock:   &sync.Mutex{},
+		writer: writer,
+	}
+}
+
+// InterceptRequest logs the request
+func (l *Logger) InterceptRequest(exchange *Exchange) error {
+	request := exchange.Request
+	return l.log("#%d [%s] %s %s%s\n", exchange.ID, exchange.Route, request.Method, request.Host, request.URL.RequestURI())
+}
+
+// InterceptResponse logs the response along with its request
+func (l *Logger) InterceptResponse(exchange *Exchange) error {
+	request := exchange.Request
+	return l.log("#%d [%s] %s %s%s -> %s\n", exchange.ID, exchange.Route, request.Method, request.Host, request.URL.RequestURI(), exchange.Response.Status)
+}
+
+// log writes a whole line at once, exchanges are intercepted from many goroutines
+func (l *Logger) log(format string, args ...interface{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := fmt.Fprintf(l.writer, format, args...); err != nil {
+		return fmt.Errorf("Failed to log exchange: %s", err)
+	}
+	return nil
+}
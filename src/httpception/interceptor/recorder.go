@@ -0,0 +1,76 @@
+package interceptor
+
+import (
+	"net/http"
+	"sync"
+)
+
+// RecordedExchange is an exchange as it reached a Recorder
+type RecordedExchange struct {
+	ID      uint64
+	Route   string
+	Request *http.Request
+
+	// nil until the response reached the recorder
+	Response *http.Response
+
+	RequestBody  []byte
+	ResponseBody []byte
+}
+
+// Recorder keeps every exchange that reaches it in memory, for tests to look at
+type Recorder struct {
+	lock      *sync.Mutex
+	exchanges []RecordedExchange
+}
+
+// NewRecorder creates an empty Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		lock:      &sync.Mutex{},
+		exchanges: make([]RecordedExchange, 0),
+	}
+}
+
+// InterceptRequest records the request, reading its body
+func (r *Recorder) InterceptRequest(exchange *Exchange) error {
+	body := ReadBody(&exchange.Request.Body)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.exchanges = append(r.exchanges, RecordedExchange{
+		ID:          exchange.ID,
+		Route:       exchange.Route,
+		Request:     exchange.Request,
+		RequestBody: body,
+	})
+	return nil
+}
+
+// InterceptResponse records the response with its request, reading its body
+func (r *Recorder) InterceptResponse(exchange *Exchange) error {
+	body := ReadBody(&exchange.Response.Body)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.exchanges {
+		if r.exchanges[i].ID == exchange.ID {
+			r.exchanges[i].Response = exchange.Response
+			r.exchanges[i].ResponseBody = body
+			return nil
+		}
+	}
+	r.exchanges = append(r.exchanges, RecordedExchange{
+		ID:           exchange.ID,
+		Route:        exchange.Route,
+		Request:      exchange.Request,
+		Response:     exchange.Response,
+		ResponseBody: body,
+	})
+	return nil
+}
+
+// Exchanges returns the exchanges recorded so far, oldest first
+func (r *Recorder) Exchanges() []RecordedExchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]RecordedExchange{}, r.exchanges...)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// tlsRecordHandshake is the first byte a TLS client sends
+const tlsRecordHandshake = 0x16
+
+// bufferedConn is a connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// serveConnect establishes the tunnel requested by CONNECT. With a certificate authority
+// the tunnel is terminated here so the requests inside it can be intercepted, otherwise
+// the bytes are passed through to the target untouched.
+func (h *HTTPProxy) serveConnect(conn net.Conn, reader *bufio.Reader, req *http.Request) {
+	target, err := ParseUpstream("https://" + req.Host)
+	if err != nil {
+		h.reportError(err)
+		response := newTextResponse(req, http.StatusBadRequest, err.Error())
+		response.Close = true
+		response.Write(conn)
+		return
+	}
+	if h.certificateAuthority == nil {
+		h.tunnel(conn, reader, target)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		h.reportError(fmt.Errorf("Failed to establish tunnel to %s: %s", target.Address, err))
+		return
+	}
+
+	// not every tunnel carries TLS, plain HTTP is served as is
+	client := &bufferedConn{Conn: conn, reader: reader}
+	if first, err := reader.Peek(1); err != nil || first[0] != tlsRecordHandshake {
+		target.TLS = false
+		h.serveConn(client, &target)
+		return
+	}
+	host, _, _ := net.SplitHostPort(target.Address)
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if len(hello.ServerName) > 0 {
+				return h.certificateAuthority.GetCertificate(hello)
+			}
+			return h.certificateAuthority.Certificate(host)
+		},
+	}
+	h.serveConn(tls.Server(client, config), &target)
+}
+
+// tunnel copies bytes between the client and the target until either side closes
+func (h *HTTPProxy) tunnel(conn net.Conn, reader *bufio.Reader, target Upstream) {
+	upstreamConn, err := net.DialTimeout("tcp", target.Address, 30*time.Second)
+	if err != nil {
+		err = fmt.Errorf("Failed to establish tunnel to %s: %w", target.Address, err)
+		h.reportError(err)
+		response := NewUpstreamErrorResponse(nil, err)
+		response.Close = true
+		response.Write(conn)
+		return
+	}
+	defer upstreamConn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		h.reportError(fmt.Errorf("Failed to establish tunnel to %s: %s", target.Address, err))
+		return
+	}
+
+	// the client may already have sent data after the CONNECT request
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstreamConn, reader)
+		closeWrite(upstreamConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstreamConn)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite tells the other side that nothing more will be sent, while still reading what it sends
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		c.CloseWrite()
+	}
+}
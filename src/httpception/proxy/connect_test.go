@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"httpception/certs"
+)
+
+func TestProxyConnect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	ca, err := certs.LoadOrCreateCertificateAuthority(dir, "localhost")
+	if err != nil {
+		t.Fatalf("LoadOrCreateCertificateAuthority failed: %s", err)
+	}
+	caPEM, err := os.ReadFile(certs.CertificatePath(dir))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		ca   *certs.CertificateAuthority
+	}{
+		{name: "passthrough"},
+		{name: "mitm", ca: ca},
+	}
+	for _, test := range tests {
+
+		// the client trusts the upstream when passing through, and the CA when intercepting
+		roots := x509.NewCertPool()
+		if test.ca == nil {
+			roots.AddCert(upstream.Certificate())
+		} else {
+			roots.AppendCertsFromPEM(caPEM)
+		}
+		_, address, recorder := startProxy(t, upstream, Options{
+			ForwardProxy:         true,
+			CertificateAuthority: test.ca,
+			Transport:            upstream.Client().Transport,
+		})
+		proxyURL, _ := url.Parse(address)
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{RootCAs: roots}},
+			Timeout:   5 * time.Second,
+		}
+
+		response, err := client.Get(upstream.URL + "/secret")
+		if err != nil {
+			t.Errorf("%s: request failed: %s", test.name, err)
+			continue
+		}
+		b, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(b) != "GET /secret" {
+			t.Errorf("%s: got %q, want %q", test.name, b, "GET /secret")
+		}
+		issuer := response.TLS.PeerCertificates[0].Issuer.String()
+		if intercepted := issuer != upstream.Certificate().Issuer.String(); intercepted != (test.ca != nil) {
+			t.Errorf("%s: the client saw a certificate issued by %s", test.name, issuer)
+		}
+
+		// only intercepted tunnels show up as exchanges
+		exchanges := recorder.Exchanges()
+		if test.ca == nil {
+			if len(exchanges) != 0 {
+				t.Errorf("%s: recorded %d exchanges, want none", test.name, len(exchanges))
+			}
+			continue
+		}
+		if len(exchanges) != 1 || exchanges[0].Route != upstream.URL || exchanges[0].Request.URL.Path != "/secret" {
+			t.Errorf("%s: recorded %+v, want one exchange on route %s", test.name, exchanges, upstream.URL)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+// Package proxy is the engine of httpception: it forwards the requests of clients to their
+// upstreams, passing every exchange through interceptors on the way.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpception/certs"
+	"httpception/interceptor"
+)
+
+var errNoRoute = errors.New("No route matches the request")
+
+// Options configures an HTTPProxy. Only the routes are needed, unless it is a forward proxy.
+type Options struct {
+
+	// where requests are forwarded, the most specific matching route wins
+	Routes []Route
+
+	// see and change every exchange on its way through, nil for none
+	Interceptors interceptor.Interceptor
+
+	// numbers the exchanges, nil to start from 1
+	IDs *IDSequence
+
+	// requests to send again, which skip the interceptors
+	Replays <-chan Replay
+
+	// reports about the proxy and the exchanges, each of which may be nil
+	ReportError         func(error)
+	ReportUpstreamError func(uint64, *http.Request, error)
+	ReportTimings       func(uint64, Timings)
+
+	// client connections served at once, 0 for no limit
+	MaxConnections int
+
+	// how long a client connection is kept open while waiting for its next request,
+	// 0 for no limit. Idle connections count towards MaxConnections.
+	IdleClientTimeout time.Duration
+
+	// sends requests to their upstream, nil for a transport with default limits
+	Transport http.RoundTripper
+
+	// forward proxy mode routes every request to its own host, and intercepts CONNECT
+	// tunnels with certificates minted by the certificate authority if there is one
+	ForwardProxy         bool
+	CertificateAuthority *certs.CertificateAuthority
+}
+
+// IDSequence hands out exchange IDs. It is shared by the proxy and the frontend so that
+// exchanges from clients, replays and imports never get the same ID.
+type IDSequence struct {
+	lastID uint64
+}
+
+// NewIDSequence creates an IDSequence that continues after lastID
+func NewIDSequence(lastID uint64) *IDSequence {
+	return &IDSequence{lastID: lastID}
+}
+
+// Next returns a new exchange ID
+func (s *IDSequence) Next() uint64 {
+	return atomic.AddUint64(&s.lastID, 1)
+}
+
+// HTTPProxy proxies requests while allowing them to be intercepted
+type HTTPProxy struct {
+	listener       net.Listener
+	replayChan     <-chan Replay
+	router         *Router
+	interceptors   interceptor.Interceptor
+	ids            *IDSequence
+	maxConnections int
+	idleTimeout    time.Duration
+	transport      http.RoundTripper
+
+	// forward proxy mode routes every request to its own host
+	forwardProxy         bool
+	certificateAuthority *certs.CertificateAuthority
+
+	// reports
+	reportError         func(error)
+	reportUpstreamError func(uint64, *http.Request, error)
+	reportTimings       func(uint64, Timings)
+
+	// the client connections being served, and whether a request is in progress on them
+	lock        *sync.Mutex
+	connections map[net.Conn]bool
+	closing     bool
+	closeOnce   sync.Once
+	closeErr    error
+	done        chan struct{}
+}
+
+// NewHTTPProxy creates a proxy for the connections accepted by a listener
+func NewHTTPProxy(listener net.Listener, options Options) *HTTPProxy {
+	h := &HTTPProxy{
+		listener:             listener,
+		replayChan:           options.Replays,
+		router:               NewRouter(options.Routes),
+		interceptors:         options.Interceptors,
+		ids:                  options.IDs,
+		maxConnections:       options.MaxConnections,
+		idleTimeout:          options.IdleClientTimeout,
+		transport:            options.Transport,
+		forwardProxy:         options.ForwardProxy,
+		certificateAuthority: options.CertificateAuthority,
+		reportError:          options.ReportError,
+		reportUpstreamError:  options.ReportUpstreamError,
+		reportTimings:        options.ReportTimings,
+		lock:                 &sync.Mutex{},
+		connections:          make(map[net.Conn]bool),
+		done:                 make(chan struct{}),
+	}
+	if h.interceptors == nil {
+		h.interceptors = interceptor.NewChain()
+	}
+	if h.ids == nil {
+		h.ids = NewIDSequence(0)
+	}
+	if h.transport == nil {
+		h.transport = NewUpstreamTransport(16, 90*time.Second, 0, nil)
+	}
+	if h.reportError == nil {
+		h.reportError = func(error) {}
+	}
+	if h.reportUpstreamError == nil {
+		h.reportUpstreamError = func(uint64, *http.Request, error) {}
+	}
+	if h.reportTimings == nil {
+		h.reportTimings = func(uint64, Timings) {}
+	}
+	return h
+}
+
+// Start serves the connections of the listener, each in its own goroutine, until the
+// proxy is closed
+func (h *HTTPProxy) Start() {
+	go h.serveReplays()
+
+	// a full semaphore blocks accepting more connections until one is done
+	var semaphore chan struct{}
+	if h.maxConnections > 0 {
+		semaphore = make(chan struct{}, h.maxConnections)
+	}
+	for {
+		if semaphore != nil {
+			semaphore <- struct{}{}
+		}
+		conn, err := h.listener.Accept()
+		if err != nil {
+			if semaphore != nil {
+				<-semaphore
+			}
+			if h.isClosing() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			h.reportError(fmt.Errorf("Failed to accept connection: %s", err))
+			continue
+		}
+		go func(conn net.Conn) {
+			if semaphore != nil {
+				defer func() { <-semaphore }()
+			}
+			h.serveConn(conn, nil)
+		}(conn)
+	}
+}
+
+// Shutdown stops accepting connections and closes the idle ones, then waits for the
+// requests being served to be answered before closing their connections. Once the
+// context is done the remaining connections, such as CONNECT tunnels, are closed at once.
+func (h *HTTPProxy) Shutdown(ctx context.Context) error {
+	h.lock.Lock()
+	h.closing = true
+	for conn, active := range h.connections {
+		if !active {
+			conn.Close()
+		}
+	}
+	h.lock.Unlock()
+	err := h.closeListener()
+
+	// connections close themselves once their request is answered
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for h.openConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			h.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Close stops accepting connections and closes every open one at once
+func (h *HTTPProxy) Close() error {
+	h.lock.Lock()
+	h.closing = true
+	for conn := range h.connections {
+		conn.Close()
+	}
+	h.lock.Unlock()
+	return h.closeListener()
+}
+
+// closeListener closes the listener the first time it is called, and lets go of the
+// connections kept open to upstreams
+func (h *HTTPProxy) closeListener() error {
+	h.closeOnce.Do(func() {
+		close(h.done)
+		h.closeErr = h.listener.Close()
+		closeIdleConnections(h.transport)
+		for _, route := range h.router.routes {
+			closeIdleConnections(route.Transport)
+		}
+	})
+	return h.closeErr
+}
+
+// closeIdleConnections closes the idle connections of a transport that keeps them
+func closeIdleConnections(transport http.RoundTripper) {
+	if transport, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (h *HTTPProxy) isClosing() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.closing
+}
+
+func (h *HTTPProxy) openConnections() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.connections)
+}
+
+// setActive records whether a request is being served on a connection, and reports
+// whether the connection should be served at all
+func (h *HTTPProxy) setActive(conn net.Conn, active bool) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closing && !active {
+		return false
+	}
+	h.connections[conn] = active
+	return true
+}
+
+func (h *HTTPProxy) forget(conn net.Conn) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.connections, conn)
+}
+
+// serveConn serves requests from a client connection until it is closed. Requests
+// are answered in the order they were read, which keeps pipelined responses in order.
+// Requests on an intercepted CONNECT tunnel are sent to the tunnel's upstream.
+func (h *HTTPProxy) serveConn(conn net.Conn, tunnel *Upstream) {
+	defer conn.Close()
+	defer h.forget(conn)
+	reader := bufio.NewReader(conn)
+
+	// a connection is idle while waiting for its next request
+	for h.setActive(conn, false) {
+
+		// read/parse request, giving up on clients that stay idle for too long so they
+		// do not hold on to a connection slot
+		if h.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.idleTimeout))
+		}
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) && !h.isClosing() {
+				h.reportError(fmt.Errorf("Failed to parse http request: %s", err))
+			}
+			return
+		}
+		if h.idleTimeout > 0 {
+			conn.SetReadDeadline(time.Time{})
+		}
+		h.setActive(conn, true)
+		if h.forwardProxy && req.Method == http.MethodConnect {
+			h.serveConnect(conn, reader, req)
+			return
+		}
+		if !h.serveRequest(conn, req, tunnel) {
+			return
+		}
+	}
+}
+
+// serveRequest proxies a single request and reports whether the connection can be reused
+func (h *HTTPProxy) serveRequest(conn net.Conn, req *http.Request, tunnel *Upstream) bool {
+
+	// whatever is left of the body has to be consumed before the next request can be read
+	body := req.Body
+	defer io.Copy(io.Discard, body)
+	keepAlive := !req.Close
+
+	// pick where the request goes
+	route, err := h.selectRoute(req, tunnel)
+	if err != nil {
+		h.reportError(err)
+		statusCode := http.StatusBadRequest
+		if err == errNoRoute {
+			statusCode = http.StatusBadGateway
+		}
+		response := newTextResponse(req, statusCode, err.Error())
+		response.Close = true
+		response.Write(conn)
+		return false
+	}
+	upstream := route.Upstream
+
+	// rewrite the request Host header, interceptors match on the one the client sent
+	clientScheme, clientHost := "http", req.Host
+	if _, ok := conn.(*tls.Conn); ok {
+		clientScheme = "https"
+	}
+	req = h.rewriteRequest(req, upstream)
+
+	// time the exchange until the response was sent
+	id := h.ids.Next()
+	recorder := newTimingRecorder()
+	defer func() { h.reportTimings(id, recorder.result()) }()
+
+	// intercept the request
+	exchange := &interceptor.Exchange{ID: id, Route: route.Name, ClientScheme: clientScheme, ClientHost: clientHost, Request: req}
+	if err := h.interceptors.InterceptRequest(exchange); err != nil {
+		h.reportError(err)
+	}
+	if exchange.Dropped() {
+
+		// the request was dropped, close the connection without answering
+		return false
+	}
+	exchange.CompleteResponse()
+	req, response := exchange.Request, exchange.Response
+
+	// forward the request, unless it was already answered
+	if response == nil {
+
+		// keep the body, so response interceptors can still read it once it was sent
+		interceptor.ReadBody(&req.Body)
+		response, err = h.forwardRequest(req, route, recorder)
+		if err == nil {
+			response.Body = recorder.body(response.Body, nil)
+		} else {
+
+			// answer on behalf of the unreachable upstream
+			h.reportError(err)
+			h.reportUpstreamError(id, req, err)
+			response = NewUpstreamErrorResponse(req, err)
+		}
+
+		// intercept the response
+		exchange.Response = response
+		if err := h.interceptors.InterceptResponse(exchange); err != nil {
+			h.reportError(err)
+		}
+		exchange.CompleteResponse()
+		response = exchange.Response
+		if exchange.Dropped() {
+			response.Body.Close()
+			return false
+		}
+	}
+	defer response.Body.Close()
+
+	// a body without a length or chunking can only be delimited by closing the connection
+	if response.ContentLength < 0 && !isChunked(response.TransferEncoding) {
+		keepAlive = false
+	}
+
+	// a proxy that is shutting down closes connections once their request is answered
+	if h.isClosing() {
+		keepAlive = false
+	}
+	if !keepAlive {
+		response.Close = true
+	}
+
+	// send back the response to the caller
+	if err := response.Write(conn); err != nil {
+		h.reportError(fmt.Errorf("Failed to write response: %s", err))
+		return false
+	}
+	return !response.Close
+}
+
+// serveReplays forwards the requests the frontend replays, each in its own goroutine
+func (h *HTTPProxy) serveReplays() {
+	for {
+		select {
+		case replay := <-h.replayChan:
+			go h.serveReplay(replay)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Replay asks the proxy to send a request from the history again. The proxy answers
+// on ResponseChan, with a synthetic response if the upstream could not be reached.
+type Replay struct {
+	ExchangeID   uint64
+	Route        string
+	Request      *http.Request
+	ResponseChan chan *http.Response
+}
+
+// serveReplay forwards a replayed request to the upstream of the route it first took
+func (h *HTTPProxy) serveReplay(replay Replay) {
+	req := replay.Request
+	route, ok := h.router.Named(replay.Route)
+
+	// requests on a tunnel or in forward proxy mode are named after their upstream
+	if !ok && strings.Contains(replay.Route, "://") {
+		upstream, err := ParseUpstream(replay.Route)
+		route, ok = Route{Name: replay.Route, Upstream: upstream}, err == nil
+	}
+	if !ok {
+		var err error
+		if route, err = h.selectRoute(req, nil); err != nil {
+			h.reportError(err)
+			replay.ResponseChan <- newTextResponse(req, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	req = h.rewriteRequest(req, route.Upstream)
+
+	// the exchange is over once the frontend is done with the response
+	recorder := newTimingRecorder()
+	response, err := h.forwardRequest(req, route, recorder)
+	if err != nil {
+		h.reportError(err)
+		h.reportUpstreamError(replay.ExchangeID, req, err)
+		response = NewUpstreamErrorResponse(req, err)
+	}
+	response.Body = recorder.body(response.Body, func() { h.reportTimings(replay.ExchangeID, recorder.result()) })
+	replay.ResponseChan <- response
+}
+
+// selectRoute picks the route of a request: the target of the tunnel it arrived on, the
+// routing table, or in forward proxy mode the host the request names
+func (h *HTTPProxy) selectRoute(request *http.Request, tunnel *Upstream) (Route, error) {
+	if tunnel != nil {
+		return Route{Name: tunnel.String(), Upstream: *tunnel}, nil
+	}
+	if route, ok := h.router.Match(request); ok {
+		return route, nil
+	}
+	if h.forwardProxy {
+		upstream, err := upstreamFromRequest(request)
+		if err != nil {
+			return Route{}, err
+		}
+		return Route{Name: upstream.Address, Upstream: upstream}, nil
+	}
+	return Route{}, errNoRoute
+}
+
+// forwardRequest sends a request to the upstream of its route, with the route's own
+// transport if it has one
+func (h *HTTPProxy) forwardRequest(request *http.Request, route Route, recorder *timingRecorder) (*http.Response, error) {
+	upstream, transport := route.Upstream, h.transport
+	if route.Transport != nil {
+		transport = route.Transport
+	}
+
+	// the transport sends client requests, so address it to the upstream
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), recorder.trace()))
+	request.RequestURI = ""
+	request.URL.Scheme = upstream.Scheme()
+	request.URL.Host = upstream.Address
+	request.Close = false
+	removeHopHeaders(request.Header)
+
+	// forward request over a pooled connection, which is returned once the body is closed
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to forward request to %s: %w", upstream, err)
+	}
+	removeHopHeaders(response.Header)
+	return response, nil
+}
+
+func (h *HTTPProxy) rewriteRequest(request *http.Request, upstream Upstream) *http.Request {
+	request.Host = upstream.Host()
+	return request
+}
+
+// isTimeout reports whether a read failed because its deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isChunked(transferEncoding []string) bool {
+	return len(transferEncoding) > 0 && transferEncoding[0] == "chunked"
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"httpception/interceptor"
+)
+
+// startProxy runs a proxy in front of an upstream, unless the options have routes of their
+// own, recording every exchange after the interceptors in the options
+func startProxy(t *testing.T, upstream *httptest.Server, options Options) (*HTTPProxy, string, *interceptor.Recorder) {
+	if options.Routes == nil {
+		route, err := NewRoute("", "", "", upstream.URL)
+		if err != nil {
+			t.Fatalf("NewRoute failed: %s", err)
+		}
+		options.Routes = []Route{route}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	recorder := interceptor.NewRecorder()
+	if options.Interceptors == nil {
+		options.Interceptors = recorder
+	} else {
+		options.Interceptors = interceptor.NewChain(options.Interceptors, recorder)
+	}
+	if options.ReportError == nil {
+		options.ReportError = func(err error) { t.Errorf("proxy reported: %s", err) }
+	}
+	p := NewHTTPProxy(listener, options)
+	go p.Start()
+	t.Cleanup(func() { p.Close() })
+	return p, "http://" + listener.Addr().String(), recorder
+}
+
+func TestProxyKeepAlive(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Host", r.Host)
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	defer upstream.Close()
+	_, address, recorder := startProxy(t, upstream, Options{})
+
+	client := &http.Client{Transport: &http.Transport{}}
+	reused := make([]bool, 0, 2)
+	for _, body := range []string{"one", "two"} {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+		}
+		request, _ := http.NewRequest("POST", address+"/echo", strings.NewReader(body))
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		b, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(b) != "POST /echo "+body {
+			t.Errorf("response body = %q, want %q", b, "POST /echo "+body)
+		}
+		if host := response.Header.Get("X-Host"); host != upstream.Listener.Addr().String() {
+			t.Errorf("upstream saw Host %q, want %q", host, upstream.Listener.Addr().String())
+		}
+	}
+	if len(reused) != 2 || reused[0] || !reused[1] {
+		t.Errorf("connection reuse = %v, want the second request on the first connection", reused)
+	}
+
+	exchanges := recorder.Exchanges()
+	if len(exchanges) != 2 {
+		t.Fatalf("recorded %d exchanges, want 2", len(exchanges))
+	}
+	for i, body := range []string{"one", "two"} {
+		exchange := exchanges[i]
+		if exchange.ID != uint64(i+1) || exchange.Route != "default" {
+			t.Errorf("exchange %d is #%d on route %q, want #%d on default", i, exchange.ID, exchange.Route, i+1)
+		}
+		if string(exchange.RequestBody) != body || string(exchange.ResponseBody) != "POST /echo "+body {
+			t.Errorf("exchange %d recorded %q -> %q", i, exchange.RequestBody, exchange.ResponseBody)
+		}
+		if exchange.Response == nil || exchange.Response.StatusCode != http.StatusOK {
+			t.Errorf("exchange %d recorded response %+v, want 200", i, exchange.Response)
+		}
+	}
+}
+
+func TestProxyShutdownWaitsForRequests(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer upstream.Close()
+	p, address, _ := startProxy(t, upstream, Options{})
+
+	// an idle keep-alive connection does not hold up the shutdown
+	idle, err := net.Dial("tcp", strings.TrimPrefix(address, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer idle.Close()
+
+	answered := make(chan string, 1)
+	go func() {
+		response, err := http.Get(address + "/slow")
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		answered <- string(b)
+	}()
+	<-arrived
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the request was answered", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := http.Get(address + "/late"); err == nil {
+		t.Errorf("new request was served during shutdown")
+	}
+
+	close(release)
+	if body := <-answered; body != "done" {
+		t.Errorf("request in flight got %q, want %q", body, "done")
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown did not return once the request was answered")
+	}
+}
+
+func TestProxyIdleClientTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	_, address, _ := startProxy(t, upstream, Options{MaxConnections: 1, IdleClientTimeout: 50 * time.Millisecond})
+
+	// the idle connection takes the only slot until it times out
+	idle, err := net.Dial("tcp", strings.TrimPrefix(address, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer idle.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(address + "/")
+	if err != nil {
+		t.Fatalf("request failed while an idle client held the slot: %s", err)
+	}
+	response.Body.Close()
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection read %v, want it closed", err)
+	}
+}
+
+func TestProxyInterceptors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	// interceptors that leave out the body, header and request of the responses they set
+	answer := func(exchange *interceptor.Exchange) error {
+		exchange.Response = &http.Response{StatusCode: http.StatusNoContent}
+		return nil
+	}
+	replace := func(exchange *interceptor.Exchange) error {
+		exchange.Response = &http.Response{StatusCode: http.StatusTeapot}
+		return nil
+	}
+	tests := []struct {
+		name        string
+		interceptor interceptor.Funcs
+		status      int
+		body        string
+	}{
+		{name: "forward", interceptor: interceptor.Funcs{}, status: http.StatusOK, body: "upstream"},
+		{name: "answer", interceptor: interceptor.Funcs{Request: answer}, status: http.StatusNoContent},
+		{name: "replace", interceptor: interceptor.Funcs{Response: replace}, status: http.StatusTeapot},
+	}
+	for _, test := range tests {
+		_, address, _ := startProxy(t, upstream, Options{Interceptors: test.interceptor})
+		client := &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}
+		for i := 0; i < 2; i++ {
+			response, err := client.Get(address + "/")
+			if err != nil {
+				t.Fatalf("%s: request %d failed: %s", test.name, i, err)
+			}
+			b, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != test.status || string(b) != test.body {
+				t.Errorf("%s: request %d got %d %q, want %d %q", test.name, i, response.StatusCode, b, test.status, test.body)
+			}
+		}
+	}
+}
+
+func TestProxyRouteTransport(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+
+	// only the trusted route is dialed with a TLS configuration that trusts the upstream
+	trusted, _ := NewRoute("", "", "/trusted", upstream.URL)
+	trusted.Transport = upstream.Client().Transport
+	untrusted, _ := NewRoute("", "", "/untrusted", upstream.URL)
+	_, address, _ := startProxy(t, upstream, Options{
+		Routes:      []Route{trusted, untrusted},
+		ReportError: func(error) {},
+	})
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/trusted", status: http.StatusOK},
+		{path: "/untrusted", status: http.StatusBadGateway},
+		{path: "/trusted/again", status: http.StatusOK},
+	}
+	for _, test := range tests {
+		response, err := http.Get(address + test.path)
+		if err != nil {
+			t.Fatalf("request for %s failed: %s", test.path, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("%s answered %d, want %d", test.path, response.StatusCode, test.status)
+		}
+	}
+}
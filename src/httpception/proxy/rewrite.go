@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpception/interceptor"
+)
+
+// RewriteRule changes the requests or responses of the exchanges it matches
+type RewriteRule struct {
+	Name  string
+	Phase interceptor.Phase
+
+	// rules run before the debugger intercepts, or after it so they also apply to edits
+	After bool
+
+	// empty conditions match anything, the host and path are matched like those of a route
+	Route  string
+	Method string
+	match  Route
+
+	SetHeaders    map[string]string
+	AddHeaders    map[string]string
+	RemoveHeaders []string
+	ReplaceBody   []replacement
+
+	// only for requests
+	RewritePath *replacement
+
+	// only for responses, 0 keeps the status
+	Status int
+}
+
+// replacement replaces every match of a regular expression
+type replacement struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// rewriteConfig is a rewrite rule as it appears in a rewrites file
+type rewriteConfig struct {
+	Name          string              `json:"name"`
+	Phase         string              `json:"phase"`
+	After         bool                `json:"after"`
+	Route         string              `json:"route"`
+	Method        string              `json:"method"`
+	Host          string              `json:"host"`
+	Path          string              `json:"path"`
+	SetHeaders    map[string]string   `json:"setHeaders"`
+	AddHeaders    map[string]string   `json:"addHeaders"`
+	RemoveHeaders []string            `json:"removeHeaders"`
+	ReplaceBody   []replacementConfig `json:"replaceBody"`
+	RewritePath   *replacementConfig  `json:"rewritePath"`
+	Status        int                 `json:"status"`
+}
+
+type replacementConfig struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// newRewriteRule checks and compiles a rule from a rewrites file
+func newRewriteRule(config rewriteConfig) (RewriteRule, error) {
+	rule := RewriteRule{
+		Name:          config.Name,
+		After:         config.After,
+		Route:         config.Route,
+		Method:        config.Method,
+		match:         Route{Host: strings.ToLower(config.Host), PathPrefix: config.Path},
+		SetHeaders:    config.SetHeaders,
+		AddHeaders:    config.AddHeaders,
+		RemoveHeaders: config.RemoveHeaders,
+		Status:        config.Status,
+	}
+	switch strings.ToLower(config.Phase) {
+	case "", "request":
+		rule.Phase = interceptor.RequestPhase
+	case "response":
+		rule.Phase = interceptor.ResponsePhase
+	default:
+		return rule, fmt.Errorf("Rewrite rule %s has unknown phase %s, expected request or response", config.Name, config.Phase)
+	}
+	if rule.Phase == interceptor.RequestPhase && rule.Status != 0 {
+		return rule, fmt.Errorf("Rewrite rule %s overrides the status of a request", config.Name)
+	}
+	if rule.Phase == interceptor.ResponsePhase && config.RewritePath != nil {
+		return rule, fmt.Errorf("Rewrite rule %s rewrites the path of a response", config.Name)
+	}
+	for _, c := range config.ReplaceBody {
+		r, err := newReplacement(c)
+		if err != nil {
+			return rule, fmt.Errorf("Rewrite rule %s has an invalid body pattern: %s", config.Name, err)
+		}
+		rule.ReplaceBody = append(rule.ReplaceBody, r)
+	}
+	if config.RewritePath != nil {
+		r, err := newReplacement(*config.RewritePath)
+		if err != nil {
+			return rule, fmt.Errorf("Rewrite rule %s has an invalid path pattern: %s", config.Name, err)
+		}
+		rule.RewritePath = &r
+	}
+	return rule, nil
+}
+
+func newReplacement(config replacementConfig) (replacement, error) {
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return replacement{}, err
+	}
+	return replacement{pattern: pattern, replacement: config.Replacement}, nil
+}
+
+// LoadRewriteRules reads rewrite rules from a JSON file holding a list of rules
+func LoadRewriteRules(path string) ([]RewriteRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read rewrite rules: %s", err)
+	}
+	var configs []rewriteConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed to parse rewrite rules in %s: %s", path, err)
+	}
+	rules := make([]RewriteRule, 0, len(configs))
+	for _, config := range configs {
+		rule, err := newRewriteRule(config)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to an exchange, whose host is the one the client
+// asked for
+func (r RewriteRule) matches(exchange *interceptor.Exchange, request *http.Request) bool {
+	route, host := exchange.Route, normalizeHost(exchange.ClientHost)
+	if len(r.Route) > 0 && r.Route != route {
+		return false
+	}
+	if len(r.Method) > 0 && !strings.EqualFold(r.Method, request.Method) {
+		return false
+	}
+	return r.match.matchesHost(host) && r.match.matchesPath(request.URL.Path)
+}
+
+// Rewriter applies the rewrite rules of a file, reloading them when the file changes.
+// A nil Rewriter has no rules.
+type Rewriter struct {
+	path  string
+	file  *watchedFile
+	lock  *sync.RWMutex
+	rules []RewriteRule
+}
+
+// NewRewriter loads the rewrite rules in a file
+func NewRewriter(path string) (*Rewriter, error) {
+	r := &Rewriter{
+		path: path,
+		lock: &sync.RWMutex{},
+	}
+	file, err := newWatchedFile(path, r.load)
+	if err != nil {
+		return nil, err
+	}
+	r.file = file
+	return r, nil
+}
+
+// Watch reloads the rules when the file changes, see watchedFile.watch
+func (r *Rewriter) Watch(ctx context.Context, interval time.Duration, report func(error)) {
+	r.file.watch(ctx, interval, report)
+}
+
+// load reads the rules from the file, keeping the previous ones if that fails
+func (r *Rewriter) load() error {
+	rules, err := LoadRewriteRules(r.path)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = rules
+	return nil
+}
+
+// matching returns the rules for a phase that apply to the request of an exchange
+func (r *Rewriter) matching(phase interceptor.Phase, after bool, exchange *interceptor.Exchange, request *http.Request) []RewriteRule {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var rules []RewriteRule
+	for _, rule := range r.rules {
+		if rule.Phase == phase && rule.After == after && rule.matches(exchange, request) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// RewriteRequest applies the request rules that run before or after the debugger
+func (r *Rewriter) RewriteRequest(after bool, exchange *interceptor.Exchange) {
+	request := exchange.Request
+	for _, rule := range r.matching(interceptor.RequestPhase, after, exchange, request) {
+		rewriteHeader(rule, request.Header)
+		if rule.RewritePath != nil {
+			request.URL.Path = rule.RewritePath.pattern.ReplaceAllString(request.URL.Path, rule.RewritePath.replacement)
+			request.URL.RawPath = ""
+			if request.URL.IsAbs() {
+				request.RequestURI = request.URL.String()
+			} else if len(request.RequestURI) > 0 {
+				request.RequestURI = request.URL.RequestURI()
+			}
+		}
+		if len(rule.ReplaceBody) > 0 {
+			interceptor.SetRequestBody(request, replaceBody(rule, request.Body))
+		}
+	}
+}
+
+// RewriteResponse applies the response rules that run before or after the debugger
+func (r *Rewriter) RewriteResponse(after bool, exchange *interceptor.Exchange) {
+	response := exchange.Response
+	for _, rule := range r.matching(interceptor.ResponsePhase, after, exchange, exchange.Request) {
+		rewriteHeader(rule, response.Header)
+		if rule.Status != 0 {
+			response.StatusCode = rule.Status
+			response.Status = strconv.Itoa(rule.Status) + " " + http.StatusText(rule.Status)
+		}
+		if len(rule.ReplaceBody) > 0 {
+			interceptor.SetResponseBody(response, replaceBody(rule, response.Body))
+		}
+	}
+}
+
+// Before returns an interceptor that applies the rules that run before the debugger
+func (r *Rewriter) Before() interceptor.Interceptor {
+	return rewriteStage{rewriter: r, after: false}
+}
+
+// After returns an interceptor that applies the rules that run after the debugger
+func (r *Rewriter) After() interceptor.Interceptor {
+	return rewriteStage{rewriter: r, after: true}
+}
+
+// rewriteStage applies the rules of a Rewriter that run before or after the debugger
+type rewriteStage struct {
+	rewriter *Rewriter
+	after    bool
+}
+
+func (s rewriteStage) InterceptRequest(exchange *interceptor.Exchange) error {
+	s.rewriter.RewriteRequest(s.after, exchange)
+	return nil
+}
+
+func (s rewriteStage) InterceptResponse(exchange *interceptor.Exchange) error {
+	s.rewriter.RewriteResponse(s.after, exchange)
+	return nil
+}
+
+func rewriteHeader(rule RewriteRule, header http.Header) {
+	for _, name := range rule.RemoveHeaders {
+		header.Del(name)
+	}
+	for name, value := range rule.SetHeaders {
+		header.Set(name, value)
+	}
+	for name, value := range rule.AddHeaders {
+		header.Add(name, value)
+	}
+}
+
+// replaceBody reads a body and applies the body replacements of a rule to it
+func replaceBody(rule RewriteRule, body io.ReadCloser) []byte {
+	if body == nil {
+		return nil
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	for _, r := range rule.ReplaceBody {
+		b = r.pattern.ReplaceAll(b, []byte(r.replacement))
+	}
+	return b
+}
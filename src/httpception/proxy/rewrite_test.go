@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"httpception/interceptor"
+)
+
+// writeRules writes a rules file, moving its modification time on so a watcher notices
+// the change even within the resolution of the file system clock
+func writeRules(t *testing.T, path string, rules string, age time.Duration) {
+	if err := os.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+}
+
+func newTestRewriter(t *testing.T, rules string) *Rewriter {
+	path := filepath.Join(t.TempDir(), "rewrites.json")
+	writeRules(t, path, rules, 0)
+	rewriter, err := NewRewriter(path)
+	if err != nil {
+		t.Fatalf("NewRewriter(%s) failed: %s", rules, err)
+	}
+	return rewriter
+}
+
+func TestLoadRewriteRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		err   bool
+	}{
+		{rules: `[]`},
+		{rules: `[{"name": "a", "setHeaders": {"X-A": "1"}}]`},
+		{rules: `[{"name": "a", "phase": "Response", "status": 503}]`},
+		{rules: `[{"name": "a", "phase": "later"}]`, err: true},
+		{rules: `[{"name": "a", "status": 503}]`, err: true},
+		{rules: `[{"name": "a", "phase": "response", "rewritePath": {"pattern": "a"}}]`, err: true},
+		{rules: `[{"name": "a", "replaceBody": [{"pattern": "("}]}]`, err: true},
+		{rules: `[{"name": "a", "rewritePath": {"pattern": "("}}]`, err: true},
+		{rules: `{"name": "a"}`, err: true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "rewrites.json")
+		writeRules(t, path, test.rules, 0)
+		_, err := LoadRewriteRules(path)
+		if test.err != (err != nil) {
+			t.Errorf("LoadRewriteRules(%s) returned %v, want an error: %t", test.rules, err, test.err)
+		}
+	}
+	if _, err := LoadRewriteRules(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("LoadRewriteRules succeeded on a missing file")
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		after  bool
+		method string
+		url    string
+		header http.Header
+		body   string
+		path   string
+		uri    string
+		want   http.Header
+		result string
+	}{
+		{
+			name:   "headers",
+			rules:  `[{"setHeaders": {"X-Set": "new"}, "addHeaders": {"X-Add": "2"}, "removeHeaders": ["Cookie"]}]`,
+			url:    "/a",
+			header: http.Header{"X-Set": {"old"}, "X-Add": {"1"}, "Cookie": {"a=b"}},
+			path:   "/a",
+			want:   http.Header{"X-Set": {"new"}, "X-Add": {"1", "2"}},
+		},
+		{
+			name:  "path",
+			rules: `[{"rewritePath": {"pattern": "^/v1/", "replacement": "/v2/"}}]`,
+			url:   "/v1/users?page=2",
+			path:  "/v2/users",
+			uri:   "/v2/users?page=2",
+			want:  http.Header{},
+		},
+		{
+			name:  "absolute path",
+			rules: `[{"rewritePath": {"pattern": "^/v1/", "replacement": "/v2/"}}]`,
+			url:   "http://api.local/v1/users",
+			path:  "/v2/users",
+			uri:   "http://api.local/v2/users",
+			want:  http.Header{},
+		},
+		{
+			name:   "body",
+			rules:  `[{"replaceBody": [{"pattern": "secret-[0-9]+", "replacement": "redacted"}, {"pattern": "a", "replacement": "b"}]}]`,
+			method: "POST",
+			url:    "/login",
+			body:   "user=a&token=secret-123",
+			path:   "/login",
+			want:   http.Header{"Content-Length": {"21"}},
+			result: "user=b&token=redbcted",
+		},
+		{
+			name:  "matching rules only",
+			rules: `[{"method": "POST", "setHeaders": {"X-Post": "1"}}, {"host": "api.local", "setHeaders": {"X-Api": "1"}}, {"path": "/users", "setHeaders": {"X-Users": "1"}}, {"route": "other", "setHeaders": {"X-Other": "1"}}]`,
+			url:   "http://api.local/users/7",
+			path:  "/users/7",
+			want:  http.Header{"X-Api": {"1"}, "X-Users": {"1"}},
+		},
+		{
+			name:  "before only",
+			rules: `[{"setHeaders": {"X-Before": "1"}}, {"after": true, "setHeaders": {"X-After": "1"}}, {"phase": "response", "setHeaders": {"X-Response": "1"}}]`,
+			url:   "/",
+			path:  "/",
+			want:  http.Header{"X-Before": {"1"}},
+		},
+		{
+			name:  "after only",
+			rules: `[{"setHeaders": {"X-Before": "1"}}, {"after": true, "setHeaders": {"X-After": "1"}}]`,
+			after: true,
+			url:   "/",
+			path:  "/",
+			want:  http.Header{"X-After": {"1"}},
+		},
+	}
+	for _, test := range tests {
+		rewriter := newTestRewriter(t, test.rules)
+		method := test.method
+		if len(method) == 0 {
+			method = "GET"
+		}
+		request := httptest.NewRequest(method, test.url, strings.NewReader(test.body))
+		if !strings.Contains(test.url, "://") {
+			request.Host = "web.local:3333"
+		}
+		request.Header = test.header.Clone()
+		if request.Header == nil {
+			request.Header = http.Header{}
+		}
+
+		// the host the client asked for is matched, not the one of the upstream
+		exchange := &interceptor.Exchange{ID: 1, Route: "default", ClientHost: request.Host, Request: request}
+		request.Host = "localhost:4444"
+		rewriter.RewriteRequest(test.after, exchange)
+
+		if request.URL.Path != test.path || (len(test.uri) > 0 && request.RequestURI != test.uri) {
+			t.Errorf("%s: rewrote %s to %s (%s), want %s (%s)", test.name, test.url, request.URL.Path, request.RequestURI, test.path, test.uri)
+		}
+		for name := range request.Header {
+			if strings.Join(request.Header[name], ",") != strings.Join(test.want[name], ",") {
+				t.Errorf("%s: header %s = %v, want %v", test.name, name, request.Header[name], test.want[name])
+			}
+		}
+		for name := range test.want {
+			if _, ok := request.Header[name]; !ok {
+				t.Errorf("%s: header %s is missing", test.name, name)
+			}
+		}
+		if len(test.result) > 0 {
+			b, _ := io.ReadAll(request.Body)
+			if string(b) != test.result || request.ContentLength != int64(len(test.result)) {
+				t.Errorf("%s: body = %q (length %d), want %q", test.name, b, request.ContentLength, test.result)
+			}
+		}
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		status int
+		header string
+		body   string
+	}{
+		{name: "status", rules: `[{"phase": "response", "status": 503}]`, status: 503, body: "ok"},
+		{name: "headers", rules: `[{"phase": "response", "setHeaders": {"Cache-Control": "no-store"}}]`, status: 200, header: "no-store", body: "ok"},
+		{name: "body", rules: `[{"phase": "response", "replaceBody": [{"pattern": "ok", "replacement": "rewritten"}]}]`, status: 200, body: "rewritten"},
+		{name: "other route", rules: `[{"phase": "response", "route": "other", "status": 503}]`, status: 200, body: "ok"},
+		{name: "request rules", rules: `[{"setHeaders": {"Cache-Control": "no-store"}}]`, status: 200, body: "ok"},
+	}
+	for _, test := range tests {
+		rewriter := newTestRewriter(t, test.rules)
+		request := httptest.NewRequest("GET", "/", nil)
+		recorder := httptest.NewRecorder()
+		io.WriteString(recorder, "ok")
+		exchange := &interceptor.Exchange{ID: 1, Route: "default", ClientHost: request.Host, Request: request, Response: recorder.Result()}
+		rewriter.After().InterceptResponse(exchange)
+		rewriter.Before().InterceptResponse(exchange)
+
+		response := exchange.Response
+		b, _ := io.ReadAll(response.Body)
+		if response.StatusCode != test.status || response.Header.Get("Cache-Control") != test.header || string(b) != test.body {
+			t.Errorf("%s: rewrote the response to %s %q %q, want %d %q %q", test.name,
+				response.Status, response.Header.Get("Cache-Control"), b, test.status, test.header, test.body)
+		}
+		if test.status != 200 && response.Status != "503 Service Unavailable" {
+			t.Errorf("%s: status line %q does not match the status", test.name, response.Status)
+		}
+	}
+}
+
+func TestRewriterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rewrites.json")
+	writeRules(t, path, `[{"setHeaders": {"X-Version": "1"}}]`, time.Hour)
+	rewriter, err := NewRewriter(path)
+	if err != nil {
+		t.Fatalf("NewRewriter failed: %s", err)
+	}
+	reports := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rewriter.Watch(ctx, 10*time.Millisecond, func(err error) { reports <- err })
+
+	version := func() string {
+		request := httptest.NewRequest("GET", "/", nil)
+		rewriter.RewriteRequest(false, &interceptor.Exchange{Request: request})
+		return request.Header.Get("X-Version")
+	}
+	tests := []struct {
+		rules   string
+		err     bool
+		version string
+	}{
+		{rules: `[{"setHeaders": {"X-Version": "2"}}]`, version: "2"},
+		{rules: `[{"setHeaders": `, err: true, version: "2"},
+		{rules: `[{"setHeaders": {"X-Version": "3"}}]`, version: "3"},
+		{rules: `[]`, version: ""},
+	}
+	for i, test := range tests {
+		if got := version(); i == 0 && got != "1" {
+			t.Fatalf("the first rules set version %q, want 1", got)
+		}
+		writeRules(t, path, test.rules, time.Duration(len(tests)-i)*time.Minute)
+		select {
+		case err := <-reports:
+			if test.err != (err != nil) {
+				t.Errorf("reloading %s reported %v, want an error: %t", test.rules, err, test.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reloading %s was not reported", test.rules)
+		}
+		if got := version(); got != test.version {
+			t.Errorf("after reloading %s the rules set version %q, want %q", test.rules, got, test.version)
+		}
+	}
+
+	// a nil Rewriter has no rules
+	var none *Rewriter
+	request := httptest.NewRequest("GET", "/", nil)
+	none.RewriteRequest(false, &interceptor.Exchange{Request: request})
+	if len(request.Header) != 0 {
+		t.Errorf("a nil Rewriter changed the request: %v", request.Header)
+	}
+}
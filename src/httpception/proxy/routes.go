@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Route sends the requests for a host and path prefix to an upstream
+type Route struct {
+	Name string
+
+	// an empty host matches every host, a leading "*." matches every subdomain
+	Host       string
+	PathPrefix string
+	Upstream   Upstream
+
+	// sends the requests of the route, nil for the proxy's transport
+	Transport http.RoundTripper
+}
+
+// routeConfig is a route as it appears in a routes file
+type routeConfig struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Upstream string `json:"upstream"`
+}
+
+// NewRoute creates a route, naming it after what it matches if no name is given
+func NewRoute(name string, host string, pathPrefix string, upstream string) (Route, error) {
+	parsed, err := ParseUpstream(upstream)
+	if err != nil {
+		return Route{}, err
+	}
+	if len(pathPrefix) > 0 && !strings.HasPrefix(pathPrefix, "/") {
+		return Route{}, fmt.Errorf("Route path must start with /: %s", pathPrefix)
+	}
+	if len(name) == 0 {
+		name = host + pathPrefix
+	}
+	if len(name) == 0 {
+		name = "default"
+	}
+	return Route{
+		Name:       name,
+		Host:       strings.ToLower(host),
+		PathPrefix: pathPrefix,
+		Upstream:   parsed,
+	}, nil
+}
+
+// ParseRoute parses a route given as [host][/path]=upstream
+func ParseRoute(spec string) (Route, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return Route{}, fmt.Errorf("Route must look like [host][/path]=upstream: %s", spec)
+	}
+	match := spec[:i]
+	host, pathPrefix := match, ""
+	if j := strings.Index(match, "/"); j >= 0 {
+		host, pathPrefix = match[:j], match[j:]
+	}
+	return NewRoute(match, host, pathPrefix, spec[i+1:])
+}
+
+// LoadRoutes reads routes from a JSON file holding a list of objects with
+// name, host, path and upstream fields
+func LoadRoutes(path string) ([]Route, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read routes: %s", err)
+	}
+	var configs []routeConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed to parse routes in %s: %s", path, err)
+	}
+	routes := make([]Route, 0, len(configs))
+	for _, config := range configs {
+		route, err := NewRoute(config.Name, config.Host, config.Path, config.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Router picks the route of a request
+type Router struct {
+	routes []Route
+}
+
+// NewRouter creates a router over a routing table
+func NewRouter(routes []Route) *Router {
+	return &Router{routes: routes}
+}
+
+// Match returns the most specific route for a request. Routes for a specific host win
+// over routes for every host, then the longest path prefix wins, then the first route.
+func (r *Router) Match(request *http.Request) (Route, bool) {
+	host := requestHost(request)
+	var best Route
+	bestScore := -1
+	for _, route := range r.routes {
+		if !route.matchesHost(host) || !route.matchesPath(request.URL.Path) {
+			continue
+		}
+		score := len(route.PathPrefix)
+		if len(route.Host) > 0 {
+			score += 1 << 16
+		}
+		if score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// Named returns the route with a name
+func (r *Router) Named(name string) (Route, bool) {
+	for _, route := range r.routes {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// requestHost returns the host of a request as routes match it, lower case and without the port
+func requestHost(request *http.Request) string {
+	return normalizeHost(request.Host)
+}
+
+// normalizeHost lower cases a host and removes its port
+func normalizeHost(host string) string {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+func (r Route) matchesHost(host string) bool {
+	if len(r.Host) == 0 || r.Host == host {
+		return true
+	}
+	return strings.HasPrefix(r.Host, "*.") && strings.HasSuffix(host, r.Host[1:])
+}
+
+// matchesPath matches whole path segments, so /api matches /api/users but not /apis
+func (r Route) matchesPath(path string) bool {
+	if !strings.HasPrefix(path, r.PathPrefix) {
+		return false
+	}
+	return len(path) == len(r.PathPrefix) || strings.HasSuffix(r.PathPrefix, "/") || path[len(r.PathPrefix)] == '/'
+}
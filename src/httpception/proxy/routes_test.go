@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		spec     string
+		name     string
+		host     string
+		path     string
+		upstream string
+		err      bool
+	}{
+		{spec: "=localhost:5000", name: "default", upstream: "http://localhost:5000"},
+		{spec: "/users=localhost:5001", name: "/users", path: "/users", upstream: "http://localhost:5001"},
+		{spec: "API.local=localhost", name: "API.local", host: "api.local", upstream: "http://localhost:80"},
+		{spec: "*.local/v1=https://staging.example.com/", name: "*.local/v1", host: "*.local", path: "/v1", upstream: "https://staging.example.com:443"},
+		{spec: "localhost:5000", err: true},
+		{spec: "/users=", err: true},
+		{spec: "/users=ftp://localhost", err: true},
+	}
+	for _, test := range tests {
+		route, err := ParseRoute(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseRoute(%q) = %+v, want an error", test.spec, route)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRoute(%q) failed: %s", test.spec, err)
+			continue
+		}
+		if route.Name != test.name || route.Host != test.host || route.PathPrefix != test.path || route.Upstream.String() != test.upstream {
+			t.Errorf("ParseRoute(%q) = %s %s %s %s, want %s %s %s %s", test.spec,
+				route.Name, route.Host, route.PathPrefix, route.Upstream,
+				test.name, test.host, test.path, test.upstream)
+		}
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	var routes []Route
+	for _, spec := range []string{
+		"/users=localhost:5001",
+		"/users/admin=localhost:5002",
+		"billing.local=localhost:5003",
+		"*.shop.local=localhost:5004",
+		"*.shop.local/cart=localhost:5005",
+	} {
+		route, err := ParseRoute(spec)
+		if err != nil {
+			t.Fatalf("ParseRoute(%q) failed: %s", spec, err)
+		}
+		routes = append(routes, route)
+	}
+	catchAll, _ := NewRoute("", "", "", "localhost:5000")
+	router := NewRouter(append(routes, catchAll))
+
+	tests := []struct {
+		host  string
+		path  string
+		route string
+	}{
+		{host: "localhost:3333", path: "/", route: "default"},
+		{host: "localhost:3333", path: "/users", route: "/users"},
+		{host: "localhost:3333", path: "/users/1", route: "/users"},
+		{host: "localhost:3333", path: "/usersettings", route: "default"},
+		{host: "localhost:3333", path: "/users/admin/1", route: "/users/admin"},
+		{host: "Billing.Local:3333", path: "/users", route: "billing.local"},
+		{host: "eu.shop.local", path: "/", route: "*.shop.local"},
+		{host: "eu.shop.local", path: "/cart/1", route: "*.shop.local/cart"},
+		{host: "shop.local", path: "/cart", route: "default"},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", test.path, nil)
+		request.Host = test.host
+		route, ok := router.Match(request)
+		if !ok || route.Name != test.route {
+			t.Errorf("Match(%s%s) = %q, want %q", test.host, test.path, route.Name, test.route)
+		}
+	}
+
+	if _, ok := NewRouter(routes).Match(httptest.NewRequest("GET", "/orders", nil)); ok {
+		t.Errorf("Match(/orders) matched without a catch-all route")
+	}
+}
@@ -0,0 +1,529 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+
+	"httpception/interceptor"
+)
+
+// Script runs the onRequest and onResponse functions of a Starlark file on every exchange,
+// reloading the file when it changes. A nil Script does nothing.
+type Script struct {
+	path    string
+	file    *watchedFile
+	lock    *sync.RWMutex
+	globals starlark.StringDict
+}
+
+// NewScript loads a Starlark file that defines onRequest(req) and/or onResponse(req, resp)
+func NewScript(path string) (*Script, error) {
+	s := &Script{
+		path: path,
+		lock: &sync.RWMutex{},
+	}
+	file, err := newWatchedFile(path, s.load)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// Watch reloads the script when the file changes, see watchedFile.watch
+func (s *Script) Watch(ctx context.Context, interval time.Duration, report func(error)) {
+	s.file.watch(ctx, interval, report)
+}
+
+// load runs the file and keeps its frozen globals, which makes them safe to share
+// between the goroutines serving exchanges. The previous globals are kept if that fails.
+func (s *Script) load() error {
+	globals, err := starlark.ExecFile(s.thread(), s.path, nil, scriptBuiltins)
+	if err != nil {
+		return fmt.Errorf("Failed to load script %s: %s", s.path, scriptError(err))
+	}
+	for _, name := range []string{"onRequest", "onResponse"} {
+		if fn, ok := globals[name]; ok {
+			if _, ok := fn.(starlark.Callable); !ok {
+				return fmt.Errorf("Failed to load script %s: %s is a %s, not a function", s.path, name, fn.Type())
+			}
+		}
+	}
+	globals.Freeze()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.globals = globals
+	return nil
+}
+
+func (s *Script) thread() *starlark.Thread {
+	return &starlark.Thread{
+		Name: s.path,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Printf("Script: %s\n", msg)
+		},
+	}
+}
+
+// function returns a function the script defines, or nil
+func (s *Script) function(name string) starlark.Value {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.globals[name]
+}
+
+// InterceptRequest passes a request to onRequest and applies its changes, or drops the
+// exchange. A script that fails leaves the request as it was.
+func (s *Script) InterceptRequest(exchange *interceptor.Exchange) error {
+	fn := s.function("onRequest")
+	if fn == nil {
+		return nil
+	}
+	request := exchange.Request
+	req := newScriptRequest(exchange, request)
+	_, err := starlark.Call(s.thread(), fn, starlark.Tuple{req}, nil)
+	if err != nil {
+		return fmt.Errorf("Script failed on request %s %s: %s", request.Method, request.URL, scriptError(err))
+	}
+	if req.dropped {
+		exchange.Drop()
+		return nil
+	}
+	req.apply(request)
+	return nil
+}
+
+// InterceptResponse passes a response and its request to onResponse and applies the
+// changes to the response, or drops the exchange. A script that fails leaves the
+// response as it was.
+func (s *Script) InterceptResponse(exchange *interceptor.Exchange) error {
+	fn := s.function("onResponse")
+	if fn == nil {
+		return nil
+	}
+
+	// the request was already sent, so it can be looked at but not changed
+	request, response := exchange.Request, exchange.Response
+	req := newScriptRequest(exchange, request)
+	req.Freeze()
+	resp := newScriptResponse(response)
+	_, err := starlark.Call(s.thread(), fn, starlark.Tuple{req, resp}, nil)
+	if err != nil {
+		return fmt.Errorf("Script failed on response to %s %s: %s", request.Method, request.URL, scriptError(err))
+	}
+	if resp.dropped {
+		exchange.Drop()
+		return nil
+	}
+	resp.apply(response)
+	return nil
+}
+
+// scriptError includes the backtrace of errors raised while the script runs
+func scriptError(err error) string {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return evalErr.Backtrace()
+	}
+	return err.Error()
+}
+
+// scriptRequest is the req a script sees. Changes are only applied once the script returns.
+// Its host is the one the client asked for, the request keeps the host of its route unless
+// the script changes it.
+type scriptRequest struct {
+	route      string
+	method     string
+	url        *url.URL
+	host       string
+	clientHost string
+	header     *scriptHeader
+	body       string
+	read       string
+	dropped    bool
+	frozen     bool
+}
+
+func newScriptRequest(exchange *interceptor.Exchange, request *http.Request) *scriptRequest {
+	u := *request.URL
+	body := string(interceptor.ReadBody(&request.Body))
+	return &scriptRequest{
+		route:      exchange.Route,
+		method:     request.Method,
+		url:        &u,
+		host:       exchange.ClientHost,
+		clientHost: exchange.ClientHost,
+		header:     &scriptHeader{header: request.Header.Clone()},
+		body:       body,
+		read:       body,
+	}
+}
+
+func (r *scriptRequest) apply(request *http.Request) {
+	request.Method = r.method
+	if r.host != r.clientHost {
+		request.Host = r.host
+	}
+	request.Header = r.header.header
+	if r.url.String() != request.URL.String() {
+		request.URL = r.url
+		if request.URL.IsAbs() {
+			request.RequestURI = request.URL.String()
+		} else if len(request.RequestURI) > 0 {
+			request.RequestURI = request.URL.RequestURI()
+		}
+	}
+	if r.body != r.read {
+		interceptor.SetRequestBody(request, []byte(r.body))
+	}
+}
+
+func (r *scriptRequest) String() string {
+	return fmt.Sprintf("<request %s %s>", r.method, r.url.RequestURI())
+}
+func (r *scriptRequest) Type() string          { return "request" }
+func (r *scriptRequest) Truth() starlark.Bool  { return true }
+func (r *scriptRequest) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: request") }
+func (r *scriptRequest) Freeze() {
+	r.frozen = true
+	r.header.Freeze()
+}
+
+func (r *scriptRequest) AttrNames() []string {
+	return []string{"body", "drop", "headers", "host", "method", "route", "url"}
+}
+
+func (r *scriptRequest) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "route":
+		return starlark.String(r.route), nil
+	case "method":
+		return starlark.String(r.method), nil
+	case "url":
+		return starlark.String(r.url.RequestURI()), nil
+	case "host":
+		return starlark.String(r.host), nil
+	case "headers":
+		return r.header, nil
+	case "body":
+		return starlark.String(r.body), nil
+	case "drop":
+		return starlark.NewBuiltin("drop", dropExchange).BindReceiver(r), nil
+	}
+	return nil, nil
+}
+
+func (r *scriptRequest) SetField(name string, value starlark.Value) error {
+	if r.frozen {
+		return fmt.Errorf("cannot change the request in onResponse, it was already sent")
+	}
+	s, ok := starlark.AsString(value)
+	if !ok {
+		return fmt.Errorf("request.%s must be a string, not %s", name, value.Type())
+	}
+	switch name {
+	case "method":
+		r.method = s
+	case "url":
+		u, err := url.ParseRequestURI(s)
+		if err != nil {
+			return fmt.Errorf("invalid request.url: %s", err)
+		}
+
+		// a path keeps the scheme and host the request is addressed to
+		if !u.IsAbs() {
+			u.Scheme = r.url.Scheme
+			u.Host = r.url.Host
+		}
+		r.url = u
+	case "host":
+		r.host = s
+	case "body":
+		r.body = s
+	default:
+		return starlark.NoSuchAttrError(fmt.Sprintf("request has no settable field .%s", name))
+	}
+	return nil
+}
+
+// scriptResponse is the resp a script sees. Changes are only applied once the script returns.
+type scriptResponse struct {
+	status  int
+	header  *scriptHeader
+	body    string
+	read    string
+	dropped bool
+}
+
+func newScriptResponse(response *http.Response) *scriptResponse {
+	body := string(interceptor.ReadBody(&response.Body))
+	return &scriptResponse{
+		status: response.StatusCode,
+		header: &scriptHeader{header: response.Header.Clone()},
+		body:   body,
+		read:   body,
+	}
+}
+
+func (r *scriptResponse) apply(response *http.Response) {
+	if r.status != response.StatusCode {
+		response.StatusCode = r.status
+		response.Status = strconv.Itoa(r.status) + " " + http.StatusText(r.status)
+	}
+	response.Header = r.header.header
+	if r.body != r.read {
+		interceptor.SetResponseBody(response, []byte(r.body))
+	}
+}
+
+func (r *scriptResponse) String() string        { return fmt.Sprintf("<response %d>", r.status) }
+func (r *scriptResponse) Type() string          { return "response" }
+func (r *scriptResponse) Truth() starlark.Bool  { return true }
+func (r *scriptResponse) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: response") }
+func (r *scriptResponse) Freeze()               {}
+
+func (r *scriptResponse) AttrNames() []string {
+	return []string{"body", "drop", "headers", "status"}
+}
+
+func (r *scriptResponse) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "status":
+		return starlark.MakeInt(r.status), nil
+	case "headers":
+		return r.header, nil
+	case "body":
+		return starlark.String(r.body), nil
+	case "drop":
+		return starlark.NewBuiltin("drop", dropExchange).BindReceiver(r), nil
+	}
+	return nil, nil
+}
+
+func (r *scriptResponse) SetField(name string, value starlark.Value) error {
+	switch name {
+	case "status":
+		status, err := starlark.AsInt32(value)
+		if err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("response.status must be a status code, not %s", value)
+		}
+		r.status = status
+	case "body":
+		s, ok := starlark.AsString(value)
+		if !ok {
+			return fmt.Errorf("response.body must be a string, not %s", value.Type())
+		}
+		r.body = s
+	default:
+		return starlark.NoSuchAttrError(fmt.Sprintf("response has no settable field .%s", name))
+	}
+	return nil
+}
+
+// dropExchange is req.drop() and resp.drop(), which close the connection without answering
+func dropExchange(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	switch r := b.Receiver().(type) {
+	case *scriptRequest:
+		if r.frozen {
+			return nil, fmt.Errorf("drop: the request was already sent, drop the response instead")
+		}
+		r.dropped = true
+	case *scriptResponse:
+		r.dropped = true
+	}
+	return starlark.None, nil
+}
+
+// scriptHeader is the headers of a request or response. Indexing gets or sets the first
+// value of a header, and methods reach the others.
+type scriptHeader struct {
+	header http.Header
+	frozen bool
+}
+
+func (h *scriptHeader) String() string        { return fmt.Sprintf("<headers %v>", h.header) }
+func (h *scriptHeader) Type() string          { return "headers" }
+func (h *scriptHeader) Truth() starlark.Bool  { return len(h.header) > 0 }
+func (h *scriptHeader) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: headers") }
+func (h *scriptHeader) Freeze()               { h.frozen = true }
+
+func (h *scriptHeader) Get(key starlark.Value) (starlark.Value, bool, error) {
+	name, ok := starlark.AsString(key)
+	if !ok {
+		return nil, false, fmt.Errorf("header names are strings, not %s", key.Type())
+	}
+	values := h.header.Values(name)
+	if len(values) == 0 {
+		return nil, false, nil
+	}
+	return starlark.String(values[0]), true, nil
+}
+
+func (h *scriptHeader) SetKey(key, value starlark.Value) error {
+	return h.set(http.Header.Set, key, value)
+}
+
+// set calls a function that changes a header with the arguments a script passed
+func (h *scriptHeader) set(change func(http.Header, string, string), key, value starlark.Value) error {
+	if h.frozen {
+		return fmt.Errorf("cannot change the headers of a request that was already sent")
+	}
+	name, ok := starlark.AsString(key)
+	if !ok {
+		return fmt.Errorf("header names are strings, not %s", key.Type())
+	}
+	s, ok := starlark.AsString(value)
+	if !ok {
+		return fmt.Errorf("header values are strings, not %s", value.Type())
+	}
+	change(h.header, name, s)
+	return nil
+}
+
+func (h *scriptHeader) AttrNames() []string {
+	return []string{"add", "get", "keys", "remove", "values"}
+}
+
+func (h *scriptHeader) Attr(name string) (starlark.Value, error) {
+	for _, n := range h.AttrNames() {
+		if n == name {
+			return starlark.NewBuiltin(name, headerMethod).BindReceiver(h), nil
+		}
+	}
+	return nil, nil
+}
+
+// headerMethod implements the methods of headers:
+//
+//	get(name, default=None)  the first value of a header
+//	values(name)             every value of a header
+//	add(name, value)         adds a value to those of a header
+//	remove(name)             removes every value of a header
+//	keys()                   the names of the headers
+func headerMethod(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	h := b.Receiver().(*scriptHeader)
+	switch b.Name() {
+	case "get":
+		var name string
+		var fallback starlark.Value = starlark.None
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name, &fallback); err != nil {
+			return nil, err
+		}
+		if value, ok, _ := h.Get(starlark.String(name)); ok {
+			return value, nil
+		}
+		return fallback, nil
+	case "values":
+		var name string
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		return stringList(h.header.Values(name)), nil
+	case "add":
+		var name, value starlark.Value
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &name, &value); err != nil {
+			return nil, err
+		}
+		return starlark.None, h.set(http.Header.Add, name, value)
+	case "remove":
+		var name starlark.Value
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+			return nil, err
+		}
+		return starlark.None, h.set(func(header http.Header, name, _ string) { header.Del(name) }, name, starlark.String(""))
+	default:
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(h.header))
+		for name := range h.header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return stringList(names), nil
+	}
+}
+
+func stringList(values []string) *starlark.List {
+	list := make([]starlark.Value, 0, len(values))
+	for _, value := range values {
+		list = append(list, starlark.String(value))
+	}
+	return starlark.NewList(list)
+}
+
+// scriptBuiltins are the functions available to scripts besides those of Starlark itself,
+// enough to sign requests
+var scriptBuiltins = starlark.StringDict{
+	"sha256":        starlark.NewBuiltin("sha256", scriptSHA256),
+	"hmac_sha256":   starlark.NewBuiltin("hmac_sha256", scriptHMACSHA256),
+	"base64_encode": starlark.NewBuiltin("base64_encode", scriptBase64Encode),
+	"base64_decode": starlark.NewBuiltin("base64_decode", scriptBase64Decode),
+	"now":           starlark.NewBuiltin("now", scriptNow),
+}
+
+// scriptSHA256 is sha256(data), the hex digest of a string
+func scriptSHA256(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &data); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(data))
+	return starlark.String(hex.EncodeToString(sum[:])), nil
+}
+
+// scriptHMACSHA256 is hmac_sha256(key, data), the hex digest of a string signed with a key
+func scriptHMACSHA256(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &key, &data); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return starlark.String(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func scriptBase64Encode(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &data); err != nil {
+		return nil, err
+	}
+	return starlark.String(base64.StdEncoding.EncodeToString([]byte(data))), nil
+}
+
+func scriptBase64Decode(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &data); err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b.Name(), err)
+	}
+	return starlark.String(decoded), nil
+}
+
+// scriptNow is now(), the current Unix time in seconds
+func scriptNow(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt64(time.Now().Unix()), nil
+}
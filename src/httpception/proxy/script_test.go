@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"httpception/interceptor"
+)
+
+func newTestScript(t *testing.T, source string) (*Script, error) {
+	path := filepath.Join(t.TempDir(), "script.star")
+	if err := os.WriteFile(path, []byte(source), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	return NewScript(path)
+}
+
+// newScriptExchange creates an exchange for a request the client sent to web.local that was
+// routed to localhost:4444
+func newScriptExchange(method string, url string, body string) *interceptor.Exchange {
+	request := httptest.NewRequest(method, url, strings.NewReader(body))
+	request.Header.Set("X-Token", "a")
+	request.Header.Add("X-Token", "b")
+	request.Host = "localhost:4444"
+	return &interceptor.Exchange{ID: 1, Route: "api", ClientHost: "web.local:3333", Request: request}
+}
+
+func TestLoadScript(t *testing.T) {
+	tests := []struct {
+		source string
+		err    bool
+	}{
+		{source: ``},
+		{source: "def onRequest(req):\n    pass\n"},
+		{source: "def onResponse(req, resp):\n    pass\n"},
+		{source: "def onRequest(req)\n", err: true},
+		{source: "onRequest = 1\n", err: true},
+		{source: "fail('on load')\n", err: true},
+		{source: "x = undefined\n", err: true},
+	}
+	for _, test := range tests {
+		if _, err := newTestScript(t, test.source); test.err != (err != nil) {
+			t.Errorf("NewScript(%q) returned %v, want an error: %t", test.source, err, test.err)
+		}
+	}
+	if _, err := NewScript(filepath.Join(t.TempDir(), "missing.star")); err == nil {
+		t.Errorf("NewScript succeeded on a missing file")
+	}
+}
+
+func TestScriptRequest(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("GET/users?page=2"))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name    string
+		source  string
+		method  string
+		url     string
+		host    string
+		header  string
+		body    string
+		dropped bool
+		err     bool
+	}{
+		{
+			name:   "unchanged",
+			source: "def onResponse(req, resp):\n    pass\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", header: "",
+		},
+		{
+			name:   "read",
+			source: "def onRequest(req):\n    req.headers['X-Result'] = ' '.join([req.route, req.method, req.url, req.host, req.body])\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", header: "api GET /users?page=2 web.local:3333 ",
+		},
+		{
+			name:   "sign",
+			source: "def onRequest(req):\n    req.headers['X-Result'] = hmac_sha256('key', req.method + req.url)\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", header: signature,
+		},
+		{
+			name: "header methods",
+			source: "def onRequest(req):\n" +
+				"    h = req.headers\n" +
+				"    h.add('X-Token', 'c')\n" +
+				"    h.remove('Accept')\n" +
+				"    h['X-Result'] = ','.join(h.values('x-token') + [h['X-Token'], h.get('Accept', 'none'), str(h.get('Missing'))] + h.keys())\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", header: "a,b,c,a,none,None,X-Token",
+		},
+		{
+			name:   "rewrite",
+			source: "def onRequest(req):\n    req.method = 'POST'\n    req.url = '/v2' + req.url\n    req.host = 'api.internal'\n    req.body = 'changed'\n",
+			method: "POST", url: "/v2/users?page=2", host: "api.internal", body: "changed",
+		},
+		{
+			name:   "drop",
+			source: "def onRequest(req):\n    req.headers['X-Result'] = 'dropped'\n    req.drop()\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", dropped: true,
+		},
+		{
+			name:   "fail",
+			source: "def onRequest(req):\n    req.method = 'DELETE'\n    fail('no')\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", err: true,
+		},
+		{
+			name:   "wrong type",
+			source: "def onRequest(req):\n    req.method = 1\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", err: true,
+		},
+		{
+			name:   "invalid url",
+			source: "def onRequest(req):\n    req.url = 'users'\n",
+			method: "GET", url: "/users?page=2", host: "localhost:4444", err: true,
+		},
+	}
+	for _, test := range tests {
+		script, err := newTestScript(t, test.source)
+		if err != nil {
+			t.Fatalf("%s: NewScript failed: %s", test.name, err)
+		}
+		exchange := newScriptExchange("GET", "/users?page=2", "")
+		exchange.Request.Header.Set("Accept", "*/*")
+		err = script.InterceptRequest(exchange)
+		if test.err != (err != nil) {
+			t.Errorf("%s: InterceptRequest returned %v, want an error: %t", test.name, err, test.err)
+		}
+		if exchange.Dropped() != test.dropped {
+			t.Errorf("%s: dropped = %t, want %t", test.name, exchange.Dropped(), test.dropped)
+		}
+		if exchange.Dropped() {
+			continue
+		}
+
+		request := exchange.Request
+		b, _ := io.ReadAll(request.Body)
+		if request.Method != test.method || request.URL.RequestURI() != test.url || request.Host != test.host || string(b) != test.body {
+			t.Errorf("%s: request is %s %s %s %q, want %s %s %s %q", test.name,
+				request.Method, request.URL.RequestURI(), request.Host, b, test.method, test.url, test.host, test.body)
+		}
+		if request.Header.Get("X-Result") != test.header {
+			t.Errorf("%s: X-Result = %q, want %q", test.name, request.Header.Get("X-Result"), test.header)
+		}
+	}
+}
+
+func TestScriptResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		status  string
+		header  string
+		body    string
+		dropped bool
+		err     bool
+	}{
+		{
+			name:   "read",
+			source: "def onResponse(req, resp):\n    resp.headers['X-Result'] = '%s %s %s %d %s' % (req.method, req.url, req.headers['X-Token'], resp.status, resp.body)\n",
+			status: "200 OK", header: "GET /users a 200 upstream", body: "upstream",
+		},
+		{
+			name:   "rewrite",
+			source: "def onResponse(req, resp):\n    resp.status = 404\n    resp.body = 'gone'\n    resp.headers.add('X-Result', 'rewritten')\n",
+			status: "404 Not Found", header: "rewritten", body: "gone",
+		},
+		{
+			name:    "drop",
+			source:  "def onResponse(req, resp):\n    resp.drop()\n",
+			dropped: true,
+		},
+		{
+			name:   "frozen method",
+			source: "def onResponse(req, resp):\n    req.method = 'POST'\n",
+			status: "200 OK", body: "upstream", err: true,
+		},
+		{
+			name:   "frozen headers",
+			source: "def onResponse(req, resp):\n    req.headers['X-Late'] = '1'\n",
+			status: "200 OK", body: "upstream", err: true,
+		},
+		{
+			name:   "frozen header methods",
+			source: "def onResponse(req, resp):\n    req.headers.remove('X-Token')\n",
+			status: "200 OK", body: "upstream", err: true,
+		},
+		{
+			name:   "frozen drop",
+			source: "def onResponse(req, resp):\n    req.drop()\n",
+			status: "200 OK", body: "upstream", err: true,
+		},
+		{
+			name:   "invalid status",
+			source: "def onResponse(req, resp):\n    resp.status = 42\n",
+			status: "200 OK", body: "upstream", err: true,
+		},
+	}
+	for _, test := range tests {
+		script, err := newTestScript(t, test.source)
+		if err != nil {
+			t.Fatalf("%s: NewScript failed: %s", test.name, err)
+		}
+		exchange := newScriptExchange("GET", "/users", "")
+		recorder := httptest.NewRecorder()
+		io.WriteString(recorder, "upstream")
+		exchange.Response = recorder.Result()
+		err = script.InterceptResponse(exchange)
+		if test.err != (err != nil) {
+			t.Errorf("%s: InterceptResponse returned %v, want an error: %t", test.name, err, test.err)
+		}
+		if exchange.Dropped() != test.dropped {
+			t.Errorf("%s: dropped = %t, want %t", test.name, exchange.Dropped(), test.dropped)
+		}
+		if exchange.Dropped() {
+			continue
+		}
+
+		response := exchange.Response
+		b, _ := io.ReadAll(response.Body)
+		if response.Status != test.status || response.Header.Get("X-Result") != test.header || string(b) != test.body {
+			t.Errorf("%s: response is %s %q %q, want %s %q %q", test.name,
+				response.Status, response.Header.Get("X-Result"), b, test.status, test.header, test.body)
+		}
+		if exchange.Request.Method != "GET" || len(exchange.Request.Header.Values("X-Token")) != 2 {
+			t.Errorf("%s: onResponse changed the request that was sent", test.name)
+		}
+	}
+
+	// a nil Script does nothing
+	var none *Script
+	exchange := newScriptExchange("GET", "/", "")
+	exchange.Response = &http.Response{StatusCode: http.StatusOK}
+	if err := none.InterceptResponse(exchange); err != nil || exchange.Dropped() {
+		t.Errorf("a nil Script returned %v", err)
+	}
+}
+
+func TestScriptBuiltins(t *testing.T) {
+	tests := []struct {
+		expression string
+		result     string
+	}{
+		{expression: "sha256('abc')", result: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{expression: "base64_encode('hello')", result: "aGVsbG8="},
+		{expression: "base64_decode('aGVsbG8=')", result: "hello"},
+		{expression: "str(now() > 1700000000)", result: "True"},
+	}
+	for _, test := range tests {
+		script, err := newTestScript(t, "def onRequest(req):\n    req.headers['X-Result'] = "+test.expression+"\n")
+		if err != nil {
+			t.Fatalf("NewScript failed: %s", err)
+		}
+		exchange := newScriptExchange("GET", "/", "")
+		if err := script.InterceptRequest(exchange); err != nil {
+			t.Errorf("%s failed: %s", test.expression, err)
+			continue
+		}
+		if result := exchange.Request.Header.Get("X-Result"); result != test.result {
+			t.Errorf("%s = %q, want %q", test.expression, result, test.result)
+		}
+	}
+}
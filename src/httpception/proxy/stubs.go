@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpception/interceptor"
+)
+
+// Stub is a canned response for the requests that match all of its conditions, empty
+// ones match anything
+type Stub struct {
+	Name   string
+	Method string
+
+	// a glob as understood by path.Match
+	Path string
+
+	// the query parameters that have to be present, and have the value if one is given
+	Query map[string]string
+
+	BodyContains string
+
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// stubConfig is a stub as it appears in a stubs file
+type stubConfig struct {
+	Name         string            `json:"name"`
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Query        map[string]string `json:"query"`
+	BodyContains string            `json:"bodyContains"`
+	Status       int               `json:"status"`
+	Headers      map[string]string `json:"headers"`
+	Body         string            `json:"body"`
+
+	// read relative to the stubs file, instead of the body
+	BodyFile string `json:"bodyFile"`
+}
+
+// newStub checks a stub from a stubs file and reads its body
+func newStub(config stubConfig, directory string) (Stub, error) {
+	stub := Stub{
+		Name:         config.Name,
+		Method:       config.Method,
+		Path:         config.Path,
+		Query:        config.Query,
+		BodyContains: config.BodyContains,
+		Status:       config.Status,
+		Header:       http.Header{},
+		Body:         []byte(config.Body),
+	}
+	if _, err := path.Match(stub.Path, ""); err != nil {
+		return stub, fmt.Errorf("Stub %s has an invalid path %s: %s", config.Name, config.Path, err)
+	}
+	if stub.Status == 0 {
+		stub.Status = http.StatusOK
+	}
+	if stub.Status < 100 || stub.Status > 999 {
+		return stub, fmt.Errorf("Stub %s has an invalid status %d", config.Name, config.Status)
+	}
+	for name, value := range config.Headers {
+		stub.Header.Set(name, value)
+	}
+	if len(config.BodyFile) > 0 {
+		if len(config.Body) > 0 {
+			return stub, fmt.Errorf("Stub %s has both a body and a body file", config.Name)
+		}
+		bodyFile := config.BodyFile
+		if !filepath.IsAbs(bodyFile) {
+			bodyFile = filepath.Join(directory, bodyFile)
+		}
+		body, err := os.ReadFile(bodyFile)
+		if err != nil {
+			return stub, fmt.Errorf("Failed to read body of stub %s: %s", config.Name, err)
+		}
+		stub.Body = body
+		if len(stub.Header.Get("Content-Type")) == 0 {
+			if contentType := mime.TypeByExtension(filepath.Ext(bodyFile)); len(contentType) > 0 {
+				stub.Header.Set("Content-Type", contentType)
+			}
+		}
+	}
+	return stub, nil
+}
+
+// LoadStubs reads stubs from a JSON file holding a list of stubs
+func LoadStubs(path string) ([]Stub, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read stubs: %s", err)
+	}
+	var configs []stubConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed to parse stubs in %s: %s", path, err)
+	}
+	stubs := make([]Stub, 0, len(configs))
+	for _, config := range configs {
+		stub, err := newStub(config, filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		stubs = append(stubs, stub)
+	}
+	return stubs, nil
+}
+
+// matches reports whether the stub answers a request whose body was read
+func (s Stub) matches(request *http.Request, body []byte) bool {
+	if len(s.Method) > 0 && !strings.EqualFold(s.Method, request.Method) {
+		return false
+	}
+	if len(s.Path) > 0 {
+		if ok, _ := path.Match(s.Path, request.URL.Path); !ok {
+			return false
+		}
+	}
+	query := request.URL.Query()
+	for name, value := range s.Query {
+		values, ok := query[name]
+		if !ok || (len(value) > 0 && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	return len(s.BodyContains) == 0 || bytes.Contains(body, []byte(s.BodyContains))
+}
+
+// response creates the canned response to a request
+func (s Stub) response(request *http.Request) *http.Response {
+	header := s.Header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(s.Body)))
+	return &http.Response{
+		Status:        strconv.Itoa(s.Status) + " " + http.StatusText(s.Status),
+		StatusCode:    s.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(s.Body)),
+		ContentLength: int64(len(s.Body)),
+		Request:       request,
+	}
+}
+
+// Stubs holds the stubs of a file, reloading them when the file changes
+type Stubs struct {
+	path  string
+	file  *watchedFile
+	lock  *sync.RWMutex
+	stubs []Stub
+}
+
+// NewStubs loads the stubs in a file
+func NewStubs(path string) (*Stubs, error) {
+	s := &Stubs{
+		path: path,
+		lock: &sync.RWMutex{},
+	}
+	file, err := newWatchedFile(path, s.load)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+// Watch reloads the stubs when the file changes, see watchedFile.watch
+func (s *Stubs) Watch(ctx context.Context, interval time.Duration, report func(error)) {
+	s.file.watch(ctx, interval, report)
+}
+
+// load reads the stubs from the file, keeping the previous ones if that fails
+func (s *Stubs) load() error {
+	stubs, err := LoadStubs(s.path)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stubs = stubs
+	return nil
+}
+
+// Match returns the first stub that answers a request, whose body was read
+func (s *Stubs) Match(request *http.Request, body []byte) (Stub, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, stub := range s.stubs {
+		if stub.matches(request, body) {
+			return stub, true
+		}
+	}
+	return Stub{}, false
+}
+
+// stubTransport answers requests from stubs in place of their upstream
+type stubTransport struct {
+	stubs *Stubs
+	next  http.RoundTripper
+}
+
+// NewStubTransport creates a transport that answers the requests a stub matches, and
+// sends the others on with the next transport. Without a next transport nothing is
+// forwarded and unmatched requests are answered with 404 Not Found.
+func NewStubTransport(stubs *Stubs, next http.RoundTripper) http.RoundTripper {
+	return &stubTransport{stubs: stubs, next: next}
+}
+
+func (t *stubTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body := interceptor.ReadBody(&request.Body)
+	if stub, ok := t.stubs.Match(request, body); ok {
+		return stub.response(request), nil
+	}
+	if t.next == nil {
+		text := fmt.Sprintf("404 Not Found\n\nhttpception: no stub matches %s %s\n", request.Method, request.URL.RequestURI())
+		return newTextResponse(request, http.StatusNotFound, text), nil
+	}
+	return t.next.RoundTrip(request)
+}
+
+// CloseIdleConnections closes the idle connections of the next transport
+func (t *stubTransport) CloseIdleConnections() {
+	closeIdleConnections(t.next)
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// roundTripperFunc is a transport made of a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func newTestStubs(t *testing.T, stubs string) (*Stubs, error) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "user.json"), []byte(`{"id": 7}`), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	path := filepath.Join(dir, "stubs.json")
+	if err := os.WriteFile(path, []byte(stubs), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	return NewStubs(path)
+}
+
+func TestLoadStubs(t *testing.T) {
+	tests := []struct {
+		stubs       string
+		status      int
+		contentType string
+		body        string
+		err         bool
+	}{
+		{stubs: `[{"name": "a", "body": "ok"}]`, status: 200, body: "ok"},
+		{stubs: `[{"name": "a", "status": 201, "headers": {"Content-Type": "text/plain"}}]`, status: 201, contentType: "text/plain"},
+		{stubs: `[{"name": "a", "bodyFile": "user.json"}]`, status: 200, contentType: "application/json", body: `{"id": 7}`},
+		{stubs: `[{"name": "a", "bodyFile": "user.json", "headers": {"Content-Type": "text/plain"}}]`, status: 200, contentType: "text/plain", body: `{"id": 7}`},
+		{stubs: `[{"name": "a", "bodyFile": "missing.json"}]`, err: true},
+		{stubs: `[{"name": "a", "body": "ok", "bodyFile": "user.json"}]`, err: true},
+		{stubs: `[{"name": "a", "status": 42}]`, err: true},
+		{stubs: `[{"name": "a", "path": "/users/["}]`, err: true},
+		{stubs: `{"name": "a"}`, err: true},
+	}
+	for _, test := range tests {
+		stubs, err := newTestStubs(t, test.stubs)
+		if test.err {
+			if err == nil {
+				t.Errorf("NewStubs(%s) succeeded, want an error", test.stubs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewStubs(%s) failed: %s", test.stubs, err)
+			continue
+		}
+		stub := stubs.stubs[0]
+		if stub.Status != test.status || stub.Header.Get("Content-Type") != test.contentType || string(stub.Body) != test.body {
+			t.Errorf("NewStubs(%s) = %d %q %q, want %d %q %q", test.stubs,
+				stub.Status, stub.Header.Get("Content-Type"), stub.Body, test.status, test.contentType, test.body)
+		}
+	}
+}
+
+func TestStubTransport(t *testing.T) {
+	stubs, err := newTestStubs(t, `[
+		{"name": "login", "method": "POST", "path": "/login", "bodyContains": "\"user\": \"admin\"", "status": 403, "body": "denied"},
+		{"name": "user", "method": "GET", "path": "/users/*", "bodyFile": "user.json"},
+		{"name": "search", "path": "/search", "query": {"q": "go", "page": ""}, "body": "results"},
+		{"name": "fallback", "path": "/users/*", "body": "any method"}
+	]`)
+	if err != nil {
+		t.Fatalf("NewStubs failed: %s", err)
+	}
+	upstream := roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		recorder := httptest.NewRecorder()
+		io.WriteString(recorder, "upstream")
+		return recorder.Result(), nil
+	})
+
+	tests := []struct {
+		method  string
+		url     string
+		body    string
+		offline bool
+		status  int
+		result  string
+	}{
+		{method: "POST", url: "/login", body: `{"user": "admin"}`, status: 403, result: "denied"},
+		{method: "POST", url: "/login", body: `{"user": "guest"}`, status: 200, result: "upstream"},
+		{method: "GET", url: "/users/7", status: 200, result: `{"id": 7}`},
+		{method: "DELETE", url: "/users/7", status: 200, result: "any method"},
+		{method: "GET", url: "/users/7/orders", status: 200, result: "upstream"},
+		{method: "GET", url: "/search?q=go&page=2", status: 200, result: "results"},
+		{method: "GET", url: "/search?q=go&q=rust&page=", status: 200, result: "results"},
+		{method: "GET", url: "/search?q=rust&page=2", status: 200, result: "upstream"},
+		{method: "GET", url: "/search?q=go", status: 200, result: "upstream"},
+		{method: "GET", url: "/users/7", offline: true, status: 200, result: `{"id": 7}`},
+		{method: "GET", url: "/orders", offline: true, status: 404, result: "404 Not Found\n\nhttpception: no stub matches GET /orders\n"},
+	}
+	for _, test := range tests {
+		var next http.RoundTripper = upstream
+		if test.offline {
+			next = nil
+		}
+		request := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		response, err := NewStubTransport(stubs, next).RoundTrip(request)
+		if err != nil {
+			t.Errorf("%s %s failed: %s", test.method, test.url, err)
+			continue
+		}
+		b, _ := io.ReadAll(response.Body)
+		if response.StatusCode != test.status || string(b) != test.result {
+			t.Errorf("%s %s (offline %t) = %d %q, want %d %q", test.method, test.url, test.offline,
+				response.StatusCode, b, test.status, test.result)
+		}
+
+		// stubs answer with a length, so the connection to the client can be kept alive
+		if test.result != "upstream" && (response.ContentLength != int64(len(b)) || response.Header.Get("Content-Length") != strconv.Itoa(len(b))) {
+			t.Errorf("%s %s has length %d for a body of %d bytes", test.method, test.url, response.ContentLength, len(b))
+		}
+	}
+}
+
+func TestProxyOffline(t *testing.T) {
+	stubs, err := newTestStubs(t, `[{"name": "user", "path": "/users/*", "bodyFile": "user.json"}]`)
+	if err != nil {
+		t.Fatalf("NewStubs failed: %s", err)
+	}
+
+	// the upstream is never reached offline
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("the upstream was reached for %s", r.URL)
+	}))
+	defer upstream.Close()
+	_, address, recorder := startProxy(t, upstream, Options{Transport: NewStubTransport(stubs, nil)})
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{path: "/users/7", status: http.StatusOK, contentType: "application/json"},
+		{path: "/orders", status: http.StatusNotFound, contentType: "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		response, err := http.Get(address + test.path)
+		if err != nil {
+			t.Fatalf("request for %s failed: %s", test.path, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.status || response.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s answered %d %q, want %d %q", test.path, response.StatusCode, response.Header.Get("Content-Type"), test.status, test.contentType)
+		}
+	}
+	if exchanges := recorder.Exchanges(); len(exchanges) != len(tests) {
+		t.Errorf("recorded %d exchanges, want stubbed exchanges to show up like any other", len(exchanges))
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings break down where the time of an exchange went. Connecting is skipped when a
+// pooled connection is reused.
+type Timings struct {
+	DNS              time.Duration
+	Connect          time.Duration
+	TLSHandshake     time.Duration
+	ConnectionReused bool
+
+	// from the request being written to the first byte of the response
+	TimeToFirstByte time.Duration
+
+	// from the first byte of the response to the end of its body
+	Transfer time.Duration
+
+	// held in the debugger, which is part of the total
+	Paused time.Duration
+	Total  time.Duration
+}
+
+// timingRecorder records where the time of an exchange goes. The transport may call the
+// trace from the goroutine dialing a connection, so everything is behind a lock.
+type timingRecorder struct {
+	lock    *sync.Mutex
+	timings Timings
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+// newTimingRecorder starts timing an exchange
+func newTimingRecorder() *timingRecorder {
+	return &timingRecorder{
+		lock:  &sync.Mutex{},
+		start: time.Now(),
+	}
+}
+
+// trace records the time spent on the connection to the upstream and waiting for its response
+func (r *timingRecorder) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.timings.ConnectionReused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.timings.DNS = time.Since(r.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.timings.Connect = time.Since(r.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.timings.TLSHandshake = time.Since(r.tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.firstByte = time.Now()
+			r.timings.TimeToFirstByte = r.firstByte.Sub(r.wroteRequest)
+		},
+	}
+}
+
+// body times the transfer of a response body, which ends when it is read to the end or
+// closed. done is called once the body is closed.
+func (r *timingRecorder) body(body io.ReadCloser, done func()) io.ReadCloser {
+	return &timedBody{ReadCloser: body, recorder: r, done: done}
+}
+
+// transferred records that the response body was read
+func (r *timingRecorder) transferred() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.timings.Transfer == 0 && !r.firstByte.IsZero() {
+		r.timings.Transfer = time.Since(r.firstByte)
+	}
+}
+
+// result returns the timings recorded so far
+func (r *timingRecorder) result() Timings {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	timings := r.timings
+	timings.Total = time.Since(r.start)
+	return timings
+}
+
+// timedBody is a response body that tells a timingRecorder when it was read
+type timedBody struct {
+	io.ReadCloser
+	recorder *timingRecorder
+	done     func()
+	once     sync.Once
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.recorder.transferred()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.recorder.transferred()
+		if b.done != nil {
+			b.done()
+		}
+	})
+	return err
+}
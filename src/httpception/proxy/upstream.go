@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopHeaders only apply to a single connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Upstream is an address that requests are forwarded to
+type Upstream struct {
+	Address string
+	TLS     bool
+}
+
+// ParseUpstream parses an upstream address, which is plain host:port or a URL with an http or https scheme
+func ParseUpstream(address string) (Upstream, error) {
+	upstream := Upstream{Address: address}
+	defaultPort := "80"
+	if i := strings.Index(address, "://"); i >= 0 {
+		switch scheme := strings.ToLower(address[:i]); scheme {
+		case "http":
+		case "https":
+			upstream.TLS = true
+			defaultPort = "443"
+		default:
+			return upstream, fmt.Errorf("Unsupported upstream scheme: %s", scheme)
+		}
+		upstream.Address = strings.TrimRight(address[i+3:], "/")
+	}
+	if len(upstream.Address) == 0 {
+		return upstream, fmt.Errorf("Missing upstream host: %s", address)
+	}
+	if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
+		upstream.Address = net.JoinHostPort(upstream.Address, defaultPort)
+	}
+	return upstream, nil
+}
+
+// Scheme returns the URL scheme used to talk to the upstream
+func (u Upstream) Scheme() string {
+	if u.TLS {
+		return "https"
+	}
+	return "http"
+}
+
+// Host returns the value of the Host header for the upstream, which leaves out the default port
+func (u Upstream) Host() string {
+	host, port, err := net.SplitHostPort(u.Address)
+	if err != nil || (u.TLS && port == "443") || (!u.TLS && port == "80") {
+		return host
+	}
+	return u.Address
+}
+
+func (u Upstream) String() string {
+	return u.Scheme() + "://" + u.Address
+}
+
+// UpstreamTLSOptions configure TLS connections to an https upstream
+type UpstreamTLSOptions struct {
+	ServerName         string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// NewUpstreamTLSConfig creates the TLS configuration used to dial https upstreams
+func NewUpstreamTLSConfig(options UpstreamTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	// trust a custom CA bundle instead of the system roots
+	if len(options.CAFile) > 0 {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA bundle: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle: %s", options.CAFile)
+		}
+	}
+
+	// present a client certificate
+	if len(options.CertFile) > 0 || len(options.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// NewUpstreamTransport creates a transport that keeps idle connections to the upstream alive for reuse
+func NewUpstreamTransport(maxIdleConns int, idleTimeout time.Duration, responseTimeout time.Duration, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleTimeout,
+
+		// only the wait for the response header is limited, the body may stream for a long time
+		ResponseHeaderTimeout: responseTimeout,
+
+		// bodies are passed through exactly as the upstream sent them
+		DisableCompression: true,
+
+		// responses are written back to the client as HTTP/1.1, so never negotiate HTTP/2
+		TLSClientConfig: tlsConfig,
+		TLSNextProto:    map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+}
+
+// removeHopHeaders removes the headers that only apply to the connection they were received on
+func removeHopHeaders(header http.Header) {
+
+	// the Connection header can name additional hop-by-hop headers
+	for _, value := range header["Connection"] {
+		for _, name := range splitHeaderList(value) {
+			header.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func splitHeaderList(value string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// upstreamFromRequest determines the upstream of a request sent to a forward proxy
+func upstreamFromRequest(request *http.Request) (Upstream, error) {
+	if len(request.URL.Host) > 0 {
+		return ParseUpstream(request.URL.Scheme + "://" + request.URL.Host)
+	}
+
+	// clients that do not know they are talking to a proxy only send the Host header
+	if len(request.Host) > 0 {
+		return ParseUpstream("http://" + request.Host)
+	}
+	return Upstream{}, fmt.Errorf("Request for %s does not name a host", request.URL)
+}
+
+// NewUpstreamErrorResponse creates the response returned to the client when the upstream
+// could not be reached: 504 Gateway Timeout if it timed out, 502 Bad Gateway otherwise
+func NewUpstreamErrorResponse(request *http.Request, err error) *http.Response {
+	statusCode := http.StatusBadGateway
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		statusCode = http.StatusGatewayTimeout
+	}
+	body := fmt.Sprintf("%d %s\n\nhttpception: %s\n", statusCode, http.StatusText(statusCode), err)
+	return newTextResponse(request, statusCode, body)
+}
+
+// newTextResponse creates a plain text response generated by the proxy itself
+func newTextResponse(request *http.Request, statusCode int, text string) *http.Response {
+	body := []byte(text)
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
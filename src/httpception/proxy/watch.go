@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// watchedFile is a file that is loaded again whenever it changes
+type watchedFile struct {
+	path    string
+	load    func() error
+	modTime time.Time
+}
+
+// newWatchedFile loads a file for the first time
+func newWatchedFile(path string, load func() error) (*watchedFile, error) {
+	f := &watchedFile{path: path, load: load}
+	f.changed()
+	if err := load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// changed reports whether the file changed since it was last looked at. A file that
+// went missing counts as changed once, so it is only reported once.
+func (f *watchedFile) changed() bool {
+	var modTime time.Time
+	if info, err := os.Stat(f.path); err == nil {
+		modTime = info.ModTime()
+	}
+	if modTime.Equal(f.modTime) {
+		return false
+	}
+	f.modTime = modTime
+	return true
+}
+
+// watch checks the file every interval until the context is done, and loads it again
+// when it changed. Every load is reported, with its error if it failed. A load that fails
+// keeps what was loaded before, and the file is not loaded again until it changes.
+func (f *watchedFile) watch(ctx context.Context, interval time.Duration, report func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if f.changed() {
+				report(f.load())
+			}
+		}
+	}
+}